@@ -46,8 +46,9 @@ func main() {
 }
 
 func run(ctx context.Context, agent *agent.Agent) {
-	pollTicker := time.NewTicker(time.Duration(agent.Config.PollInterval) * time.Second)
-	reportTicker := time.NewTicker(time.Duration(agent.Config.ReportInterval) * time.Second)
+	pollInterval, reportInterval := agent.Intervals()
+	pollTicker := time.NewTicker(pollInterval)
+	reportTicker := time.NewTicker(reportInterval)
 
 	defer pollTicker.Stop()
 	defer reportTicker.Stop()
@@ -63,13 +64,57 @@ func run(ctx context.Context, agent *agent.Agent) {
 		}(i + 1)
 	}
 
+	if agent.Config.StatsDAddress != "" {
+		go func() {
+			if err := agent.StatsD.ListenUDP(ctx, agent.Config.StatsDAddress); err != nil {
+				logger.Log.Error("statsd udp listener error", zap.Error(err))
+			}
+		}()
+	}
+	if agent.Config.StatsDSocket != "" {
+		go func() {
+			if err := agent.StatsD.ListenUnixgram(ctx, agent.Config.StatsDSocket); err != nil {
+				logger.Log.Error("statsd unix listener error", zap.Error(err))
+			}
+		}()
+	}
+
+	if agent.Config.PushAddress != "" || agent.Config.PushSocket != "" {
+		go func() {
+			if err := agent.ListenPush(ctx); err != nil {
+				logger.Log.Error("push api error", zap.Error(err))
+			}
+		}()
+	}
+
+	if agent.Config.SelfMetricsAddress != "" {
+		go func() {
+			if err := agent.ListenSelfMetrics(ctx); err != nil {
+				logger.Log.Error("self metrics endpoint error", zap.Error(err))
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunScrapers(ctx)
+	}()
+
+	go agent.RunHealthChecks(ctx, reportInterval)
+	go agent.RunRemoteSettings(ctx)
+
 	for {
 		select {
 		case <-pollTicker.C:
-			agent.CollectMemStatsMetrics()
-			agent.CollectPsutilMetrics()
+			agent.Poll()
 		case <-reportTicker.C:
 			agent.AddReportJob(ctx, jobs)
+		case <-agent.SettingsUpdates():
+			pollInterval, reportInterval = agent.Intervals()
+			logger.Log.Info("apply remote settings", zap.Duration("poll_interval", pollInterval), zap.Duration("report_interval", reportInterval))
+			pollTicker.Reset(pollInterval)
+			reportTicker.Reset(reportInterval)
 		case <-ctx.Done():
 			logger.Log.Info("shutting down agent...")
 			close(jobs)
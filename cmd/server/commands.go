@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/storage"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrCommandArgs    = errors.New("invalid command arguments")
+	ErrNotPersisted   = errors.New("memory storage without storage path, imported metrics would be lost on exit")
+)
+
+// runCommand
+// runs server subcommand instead of starting server:
+//
+//	export [file] - writes snapshot of all metrics to file or stdout
+//	import [file] - loads snapshot from file or stdin, imported values replace current ones
+//
+// Storage is selected by usual flags, so metrics are migrated between memory and database modes
+// by exporting with one configuration and importing with another. Import into memory storage
+// requires storage path, metrics are saved there as a backup
+func runCommand(ctx context.Context, cfg config.ServerConfig, store *storage.Storage, args []string) error {
+	if len(args) > 2 {
+		return ErrCommandArgs
+	}
+	path := "-"
+	if len(args) == 2 {
+		path = args[1]
+	}
+
+	switch args[0] {
+	case "export":
+		return exportMetrics(ctx, store, path)
+	case "import":
+		if cfg.Engine() == config.StorageEngineMemory && cfg.StoragePath == "" {
+			return ErrNotPersisted
+		}
+		return importMetrics(ctx, store, path)
+	}
+
+	return fmt.Errorf("%w '%s'", ErrUnknownCommand, args[0])
+}
+
+func exportMetrics(ctx context.Context, store *storage.Storage, path string) error {
+	defer store.Close()
+
+	if path == "-" {
+		return store.Export(ctx, os.Stdout)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Export(ctx, f); err != nil {
+		f.Close()
+		return err
+	}
+	logger.Log.Info("Metrics exported", zap.String("path", path))
+
+	return f.Close()
+}
+
+func importMetrics(ctx context.Context, store *storage.Storage, path string) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	count, err := store.Import(ctx, data)
+	if err != nil {
+		return err
+	}
+	logger.Log.Info(fmt.Sprintf("Imported %d metrics", count), zap.String("path", path))
+
+	return store.Close()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,17 +14,20 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	chimiddleware "github.com/go-chi/chi/v5/middleware"
-	_ "github.com/jackc/pgx/v5/stdlib"
 	"go.uber.org/zap"
 
 	"github.com/derpartizanen/metrics/internal/config"
 	"github.com/derpartizanen/metrics/internal/handler"
 	"github.com/derpartizanen/metrics/internal/handler/middlewares"
 	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
 	"github.com/derpartizanen/metrics/internal/server"
 	"github.com/derpartizanen/metrics/internal/storage"
 )
 
+// historyTrimInterval is a period of removing expired history kept in server memory
+const historyTrimInterval = time.Minute
+
 var (
 	buildVersion = "N/A"
 	buildDate    = "N/A"
@@ -32,6 +36,7 @@ var (
 
 func main() {
 	cfg := config.ConfigureServer()
+	cfg.BuildVersion = buildVersion
 	cfg.LogVars()
 	err := logger.Initialize(cfg.Loglevel)
 	if err != nil {
@@ -42,10 +47,21 @@ func main() {
 	ctx := context.Background()
 	store := storage.New(ctx, *cfg)
 
-	if cfg.DatabaseDSN == "" && cfg.StoreInterval > 0 {
-		logger.Log.Debug(fmt.Sprintf("Activate periodic backups with interval %d seconds", cfg.StoreInterval))
+	if args := flag.Args(); len(args) > 0 {
+		if err := runCommand(ctx, *cfg, store, args); err != nil {
+			logger.Log.Fatal("Command failed", zap.String("command", args[0]), zap.Error(err))
+		}
+		return
+	}
+
+	backupInterval := cfg.StoreInterval
+	if cfg.WALPath != "" {
+		backupInterval = cfg.WALSnapshotInterval
+	}
+	if cfg.Engine() == config.StorageEngineMemory && backupInterval > 0 {
+		logger.Log.Debug(fmt.Sprintf("Activate periodic backups with interval %d seconds", backupInterval))
 		go func() {
-			ticker := time.NewTicker(time.Duration(cfg.StoreInterval) * time.Second)
+			ticker := time.NewTicker(time.Duration(backupInterval) * time.Second)
 			defer ticker.Stop()
 			for {
 				select {
@@ -53,7 +69,7 @@ func main() {
 					return
 				case <-ticker.C:
 					logger.Log.Debug("Running periodic backup")
-					if backupErr := store.Backup(); backupErr != nil {
+					if backupErr := store.Backup(ctx); backupErr != nil {
 						logger.Log.Error("Periodic backup failed", zap.Error(backupErr))
 					}
 				}
@@ -61,27 +77,95 @@ func main() {
 		}()
 	}
 
-	h := handler.NewHandler(store, cfg.Key)
-	r := chi.NewRouter()
+	if cfg.SeriesTTL > 0 {
+		expiryInterval := min(time.Duration(cfg.SeriesTTL)*time.Second, time.Minute)
+		logger.Log.Debug(fmt.Sprintf("Activate expiry of metrics not updated for %d seconds", cfg.SeriesTTL))
+		go func() {
+			ticker := time.NewTicker(expiryInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					count, expireErr := store.ExpireStale(ctx)
+					if expireErr != nil {
+						logger.Log.Error("Expiry of stale metrics failed", zap.Error(expireErr))
+					} else if count > 0 {
+						logger.Log.Info(fmt.Sprintf("Expired %d stale metrics", count))
+					}
+				}
+			}
+		}()
+	}
 
-	if len(cfg.CryptoKey) > 0 {
-		cm := middlewares.NewCryptoMiddleware(cfg.CryptoKey)
-		r.Use(cm.Decrypt())
+	if cfg.Engine() != config.StorageEnginePostgres {
+		go func() {
+			ticker := time.NewTicker(historyTrimInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if count := store.TrimHistory(); count > 0 {
+						logger.Log.Debug(fmt.Sprintf("Removed history of %d idle metrics", count))
+					}
+				}
+			}
+		}()
 	}
 
-	r.Use(middlewares.RequestLogger)
-	r.Use(middlewares.GzipMiddleware)
-	hm := middlewares.NewHashMiddleware(cfg.Key)
-	r.Use(hm.VerifyHash)
+	h := handler.NewHandler(store, cfg.Key).WithLimits(model.Limits{
+		MaxBatchSize:  cfg.MaxBatchSize,
+		MaxBatchBytes: cfg.MaxBatchBytes,
+	})
+	if cfg.AgentSettings != "" {
+		h.WithAgentSettings(config.NewAgentSettingsFile(cfg.AgentSettings))
+	}
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		if len(cfg.CryptoKey) > 0 {
+			cm := middlewares.NewCryptoMiddleware(cfg.CryptoKey).WithBodyLimit(int64(cfg.MaxBatchBytes))
+			r.Use(cm.Decrypt())
+		}
 
-	r.Mount("/debug", chimiddleware.Profiler())
-	r.Get("/", h.GetAllHandler)
-	r.Get("/value/{metricType}/{metricName}", h.GetHandler)
-	r.Post("/update/{metricType}/{metricName}/{metricValue}", h.UpdateHandler)
-	r.Post("/value/", h.GetJSONHandler)
-	r.Post("/update/", h.UpdateJSONHandler)
-	r.Post("/updates/", h.BatchUpdateJSONHandler)
-	r.Get("/ping", h.PingHandler)
+		bm := middlewares.NewBodyLimitMiddleware(int64(cfg.MaxBatchBytes))
+		r.Use(bm.Limit)
+
+		r.Use(middlewares.RequestLogger)
+		r.Use(middlewares.GzipMiddleware)
+		hm := middlewares.NewHashMiddleware(cfg.Key)
+		r.Use(hm.VerifyHash)
+
+		r.Mount("/debug", chimiddleware.Profiler())
+		r.Get("/", h.GetAllHandler)
+		r.Get("/value/{metricType}/{metricName}", h.GetHandler)
+		r.Delete("/value/{metricType}/{metricName}", h.DeleteHandler)
+		r.Get("/history/{metricType}/{metricName}", h.HistoryHandler)
+		r.Post("/update/{metricType}/{metricName}/{metricValue}", h.UpdateHandler)
+		r.Post("/value/", h.GetJSONHandler)
+		r.Post("/update/", h.UpdateJSONHandler)
+		r.Post("/updates/", h.BatchUpdateJSONHandler)
+		r.Get("/ping", h.PingHandler)
+		r.Get("/limits", h.LimitsHandler)
+		r.Get("/agent/settings", h.AgentSettingsHandler)
+	})
+
+	// admin endpoints are called by operators, so they are not encrypted and signed as agent requests
+	if cfg.AdminToken != "" {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(middlewares.RequestLogger)
+			r.Use(middlewares.GzipMiddleware)
+			am := middlewares.NewAdminAuthMiddleware(cfg.AdminToken)
+			r.Use(am.Verify)
+
+			r.Get("/export", h.ExportHandler)
+			r.Post("/import", h.ImportHandler)
+			r.Delete("/metrics", h.DeleteByPatternHandler)
+			r.Post("/reset/{metricName}", h.ResetCounterHandler)
+		})
+	}
 
 	srv := server.New(cfg.Host, r)
 	serverCtx, serverStopCtx := context.WithCancel(context.Background())
@@ -107,11 +191,14 @@ func main() {
 		}
 		logger.Log.Info("Server stopped gracefully")
 
-		if cfg.DatabaseDSN == "" {
-			if backupErr := store.Backup(); backupErr != nil {
-				logger.Log.Error("Metrics backup failed", zap.Error(err))
+		if cfg.Engine() == config.StorageEngineMemory {
+			if backupErr := store.Backup(context.Background()); backupErr != nil {
+				logger.Log.Error("Metrics backup failed", zap.Error(backupErr))
 			}
 		}
+		if closeErr := store.Close(); closeErr != nil {
+			logger.Log.Error("Storage close failed", zap.Error(closeErr))
+		}
 		serverStopCtx()
 	}()
 
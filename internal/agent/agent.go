@@ -2,27 +2,26 @@
 package agent
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"math/rand"
 	"net/http"
 	"reflect"
 	"runtime"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/shirou/gopsutil/v3/mem"
 	"go.uber.org/zap"
 
-	"github.com/derpartizanen/metrics/internal/compressor"
 	"github.com/derpartizanen/metrics/internal/config"
-	"github.com/derpartizanen/metrics/internal/crypto"
-	"github.com/derpartizanen/metrics/internal/hash"
 	"github.com/derpartizanen/metrics/internal/logger"
 	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/internal/statsd"
+	"github.com/derpartizanen/metrics/pkg/client"
 )
 
 type Agent struct {
@@ -30,29 +29,105 @@ type Agent struct {
 	PubKey  []byte
 	Client  *http.Client
 	Metrics []model.Metrics
+	StatsD  *statsd.Aggregator
 	mu      sync.Mutex
+	totals  map[string]uint64
+	// lastGauges keeps values of runtime gauges, so gauges not sampled during report interval are reported again
+	lastGauges map[string]*lastGauge
+
+	processMatchers []processMatcher
+	runtimeSamples  *runtimeSamples
+	scrapers        []*scraper
+	servers         []*serverTarget
+	histograms      map[string][]uint64
+	stats           selfStats
+
+	settingsMu      sync.RWMutex
+	settings        settings
+	localFilter     *metricFilter
+	aggregator      *gaugeAggregator
+	settingsUpdates chan struct{}
+}
+
+// gaugeIdleReports is a number of report intervals without a sample after which last value of gauge is forgotten
+const gaugeIdleReports = 10
+
+// lastGauge is the last value of runtime gauge and the collector it came from
+type lastGauge struct {
+	collector string
+	value     float64
+	sampled   bool
+	idle      int
 }
 
 var (
 	counter      int64
-	ErrDoRequest = errors.New("execution request error")
+	ErrDoRequest = client.ErrRequest
+	ErrStatus    = client.ErrStatus
+	ErrTooLarge  = client.ErrTooLarge
 )
 
-func New(client *http.Client, config *config.AgentConfig) *Agent {
+func New(httpClient *http.Client, config *config.AgentConfig) *Agent {
 	var pubKey []byte
 	var err error
 	if config.CryptoKey != "" {
-		pubKey, err = crypto.ReadKeyFile(config.CryptoKey)
+		pubKey, err = client.ReadPublicKey(config.CryptoKey)
 		if err != nil {
 			logger.Log.Fatal("read public key", zap.String("error", err.Error()))
 		}
 	}
-	return &Agent{Client: client, Metrics: []model.Metrics{}, Config: config, PubKey: pubKey}
+	processMatchers, err := newProcessMatchers(config.Processes)
+	if err != nil {
+		logger.Log.Fatal("invalid process matchers", zap.Error(err))
+	}
+
+	scrapers, err := newScrapers(config.ScrapeTargets, config.PollInterval)
+	if err != nil {
+		logger.Log.Fatal("invalid scrape targets", zap.Error(err))
+	}
+
+	filter, err := newMetricFilter(config.Filter)
+	if err != nil {
+		logger.Log.Fatal("invalid metric filter", zap.Error(err))
+	}
+
+	aggregator, err := newGaugeAggregator(config.GaugeAggregation, config.Aggregation)
+	if err != nil {
+		logger.Log.Fatal("invalid gauge aggregation", zap.Error(err))
+	}
+
+	agent := &Agent{
+		Client:          httpClient,
+		Metrics:         []model.Metrics{},
+		StatsD:          statsd.NewAggregator(),
+		Config:          config,
+		PubKey:          pubKey,
+		processMatchers: processMatchers,
+		runtimeSamples:  newRuntimeSamples(config.RuntimeMetrics),
+		scrapers:        scrapers,
+		settingsUpdates: make(chan struct{}, 1),
+		localFilter:     filter,
+		aggregator:      aggregator,
+		settings:        settings{filter: filter},
+	}
+	agent.servers = agent.newServerTargets(config.ServerAddresses())
+
+	return agent
 }
 
 // CollectPsutilMetrics
-// Collect mem.VirtualMemory's Total, Free, UsedPercent values
+// Collect system metrics: memory, per-core CPU utilization, load averages, disk and network stats
 func (agent *Agent) CollectPsutilMetrics() {
+	agent.CollectMemoryMetrics()
+	agent.CollectCPUMetrics()
+	agent.CollectLoadMetrics()
+	agent.CollectDiskMetrics()
+	agent.CollectNetMetrics()
+}
+
+// CollectMemoryMetrics
+// Collect mem.VirtualMemory's Total, Free, UsedPercent values
+func (agent *Agent) CollectMemoryMetrics() {
 	vm, err := mem.VirtualMemory()
 	if err != nil {
 		logger.Log.Error("virtual memory error", zap.Error(err))
@@ -61,11 +136,11 @@ func (agent *Agent) CollectPsutilMetrics() {
 
 	totalMemory := float64(vm.Total)
 	freeMemory := float64(vm.Free)
-	CPUutilization := vm.UsedPercent
+	usedMemoryPercent := vm.UsedPercent
 
 	agent.SetGaugeMetric("TotalMemory", &totalMemory)
 	agent.SetGaugeMetric("FreeMemory", &freeMemory)
-	agent.SetGaugeMetric("CPUutilization1", &CPUutilization)
+	agent.SetGaugeMetric("UsedMemoryPercent", &usedMemoryPercent)
 }
 
 // CollectMemStatsMetrics
@@ -94,9 +169,15 @@ func (agent *Agent) CollectMemStatsMetrics() {
 			value = mValue.FieldByName(metricName).Interface().(float64)
 		}
 
-		agent.SetGaugeMetric(field.Name, &value)
+		agent.setRuntimeGauge("memstats", field.Name, &value)
 	}
 
+	agent.CollectPollMetrics()
+}
+
+// CollectPollMetrics
+// Increment PollCount counter and generate RandomValue gauge
+func (agent *Agent) CollectPollMetrics() {
 	counter += 1
 	agent.SetCounterMetric("PollCount", &counter)
 
@@ -113,6 +194,21 @@ func (agent *Agent) SetGaugeMetric(metricName string, metricValue *float64) {
 	agent.Metrics = append(agent.Metrics, model.Metrics{ID: metricName, MType: model.MetricTypeGauge, Value: metricValue})
 }
 
+// setRuntimeGauge
+// updates gauge of runtime collector and remembers its value, so it is reported again
+// if the next report interval has no sample of it
+func (agent *Agent) setRuntimeGauge(collector string, metricName string, metricValue *float64) {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	agent.Metrics = append(agent.Metrics, model.Metrics{ID: metricName, MType: model.MetricTypeGauge, Value: metricValue})
+
+	if agent.lastGauges == nil {
+		agent.lastGauges = make(map[string]*lastGauge)
+	}
+	agent.lastGauges[metricName] = &lastGauge{collector: collector, value: *metricValue, sampled: true}
+}
+
 // SetCounterMetric
 // Update counter metric and append to metrics slice
 func (agent *Agent) SetCounterMetric(metricName string, metricDelta *int64) {
@@ -123,16 +219,72 @@ func (agent *Agent) SetCounterMetric(metricName string, metricDelta *int64) {
 }
 
 // AddReportJob
-// Sends collected metrics to jobs channel
+// Sends metrics collected during report interval to jobs channel
 func (agent *Agent) AddReportJob(ctx context.Context, jobs chan<- []model.Metrics) {
 	select {
 	case <-ctx.Done():
 		return
 	default:
-		jobs <- agent.Metrics
+		metrics := agent.flushMetrics()
+		if len(metrics) == 0 {
+			return
+		}
+		jobs <- metrics
+		agent.stats.queueDepth.Store(int64(len(jobs)))
 	}
 }
 
+// flushMetrics
+// returns collected and statsd metrics, aggregates gauges over report interval, applies metric filter
+// and starts new report interval. Samples are reset, so counter deltas are sent once,
+// while runtime gauges not sampled during interval are reported with their last value
+func (agent *Agent) flushMetrics() []model.Metrics {
+	var statsdMetrics []model.Metrics
+	if agent.StatsD != nil {
+		statsdMetrics = agent.StatsD.Flush()
+	}
+
+	selfMetrics := agent.stats.metrics()
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	metrics := append(agent.Metrics, agent.unsampledGauges()...)
+	metrics = append(metrics, statsdMetrics...)
+	metrics = append(metrics, selfMetrics...)
+	agent.Metrics = []model.Metrics{}
+
+	return agent.metricFilter().apply(agent.aggregator.apply(metrics))
+}
+
+// unsampledGauges
+// returns last values of runtime gauges not sampled during report interval. Gauges of disabled collectors
+// and gauges not sampled for gaugeIdleReports intervals are forgotten. Must be called with agent.mu held
+func (agent *Agent) unsampledGauges() []model.Metrics {
+	var metrics []model.Metrics
+	for _, id := range slices.Sorted(maps.Keys(agent.lastGauges)) {
+		gauge := agent.lastGauges[id]
+		if !agent.collectorEnabled(gauge.collector) {
+			delete(agent.lastGauges, id)
+			continue
+		}
+		if gauge.sampled {
+			gauge.sampled, gauge.idle = false, 0
+			continue
+		}
+
+		gauge.idle++
+		if gauge.idle > gaugeIdleReports {
+			delete(agent.lastGauges, id)
+			continue
+		}
+		value := gauge.value
+		metrics = append(metrics, model.Metrics{ID: id, MType: model.MetricTypeGauge, Value: &value})
+	}
+
+	return metrics
+}
+
 // Worker
 // reads metrics from jobs channel and sends them to server with retries
 func (agent *Agent) Worker(ctx context.Context, id int, jobs <-chan []model.Metrics) {
@@ -147,87 +299,69 @@ func (agent *Agent) Worker(ctx context.Context, id int, jobs <-chan []model.Metr
 				return
 			}
 			logger.Log.Info("worker", zap.Int("started id", id))
-			err := agent.reportMetricsWithRetry(ctx, metrics)
+			err := agent.deliver(ctx, metrics)
+			agent.stats.queueDepth.Store(int64(len(jobs)))
 			if err != nil {
+				agent.stats.batchesDropped.Add(1)
 				logger.Log.Error("send request error", zap.Error(err))
 			}
 		}
 	}
 }
 
-func (agent *Agent) reportMetricsWithRetry(ctx context.Context, metrics []model.Metrics) error {
+// reportMetricsWithRetry
+// splits metrics into batches fitting server limits and sends them in order, every batch is retried separately.
+// Returns number of delivered metrics, so the rest can be sent to another server
+func (agent *Agent) reportMetricsWithRetry(ctx context.Context, target *serverTarget, metrics []model.Metrics) (int, error) {
 	select {
 	case <-ctx.Done():
-		return nil
+		return 0, nil
 	default:
 	}
 
-	var err error
-	for i := 1; i <= agent.Config.ReportRetryCount; i++ {
-		err = agent.reportMetrics(ctx, metrics)
-		if i == agent.Config.ReportRetryCount {
-			break
-		}
-		if err != nil && errors.Is(err, ErrDoRequest) {
-			logger.Log.Info(fmt.Sprintf("retry %d to report metrics", i))
-			time.Sleep(time.Duration(i+i-1) * time.Second)
-			continue
+	sent := 0
+	limitsRefreshed := false
+	for sent < len(metrics) {
+		batches, err := agent.prepareBatches(target.client, metrics[sent:], agent.targetLimits(ctx, target))
+		if err != nil {
+			return sent, err
 		}
-		break
-	}
-
-	if err != nil {
-		logger.Log.Error("failed to report metrics", zap.Error(err))
-	}
 
-	return err
-}
-
-func (agent *Agent) reportMetrics(ctx context.Context, metrics []model.Metrics) error {
-	if len(metrics) == 0 {
-		return nil
-	}
-
-	reportURL := fmt.Sprintf("http://%s/updates/", agent.Config.Address)
-
-	jsonStr, err := json.Marshal(metrics)
-	if err != nil {
-		return errors.New("can't marshal data")
-	}
+		for _, b := range batches {
+			err = agent.sendBatchWithRetry(ctx, target, b)
+			if err != nil {
+				break
+			}
+			sent += b.Count
+		}
 
-	gzipData, err := compressor.Compress(jsonStr)
-	if err != nil {
-		return errors.New("can't compress data")
-	}
-	b := gzipData
-	if agent.Config.CryptoKey != "" {
-		encodedBytes, err := crypto.Encrypt(gzipData, agent.PubKey)
+		// server limits could be changed, so refresh them once and split the rest of metrics again
+		if errors.Is(err, ErrTooLarge) && !limitsRefreshed {
+			limitsRefreshed = true
+			agent.refreshLimits(ctx, target)
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("failed to encode request body: %w", err)
+			logger.Log.Error("failed to report metrics", zap.String("address", target.address), zap.Error(err))
+			return sent, err
 		}
-		b = encodedBytes
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reportURL, bytes.NewBuffer(b))
-	if err != nil {
-		return errors.New("new request error")
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Content-Encoding", "gzip")
-
-	if agent.Config.HashKey != "" {
-		requestHash := hash.Calc(agent.Config.HashKey, jsonStr)
-		req.Header.Add("HashSHA256", requestHash)
-	}
+	return sent, nil
+}
 
-	res, err := agent.Client.Do(req)
+// sendBatchWithRetry
+// sends batch with client's retries, failed attempts are counted in self metrics
+func (agent *Agent) sendBatchWithRetry(ctx context.Context, target *serverTarget, b *client.Batch) error {
+	err := target.client.SendBatch(ctx, b)
 	if err != nil {
-		return ErrDoRequest
+		agent.stats.batchesFailed.Add(1)
+		return err
 	}
 
-	logger.Log.Debug(fmt.Sprintf("send batch request with %d metrics", len(metrics)))
-	res.Body.Close()
+	logger.Log.Debug(fmt.Sprintf("send batch request with %d metrics", b.Count))
+	agent.stats.batchesSent.Add(1)
+	agent.stats.lastReport.Store(time.Now().Unix())
 
 	return nil
 }
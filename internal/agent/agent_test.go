@@ -1,11 +1,31 @@
 package agent
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/derpartizanen/metrics/internal/config"
 	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/internal/statsd"
+	"github.com/derpartizanen/metrics/pkg/client"
 )
 
 func TestAgent_CollectMemStatsMetrics(t *testing.T) {
@@ -54,7 +74,11 @@ func TestAgent_CollectPsutilMetrics(t *testing.T) {
 	}{
 		{name: "TotalMemory", metric: "TotalMemory", wantType: "gauge"},
 		{name: "FreeMemory", metric: "FreeMemory", wantType: "gauge"},
+		{name: "UsedMemoryPercent", metric: "UsedMemoryPercent", wantType: "gauge"},
 		{name: "CPUutilization1", metric: "CPUutilization1", wantType: "gauge"},
+		{name: "LoadAverage1", metric: "LoadAverage1", wantType: "gauge"},
+		{name: "LoadAverage5", metric: "LoadAverage5", wantType: "gauge"},
+		{name: "LoadAverage15", metric: "LoadAverage15", wantType: "gauge"},
 	}
 
 	metricsAgent.CollectPsutilMetrics()
@@ -75,3 +99,764 @@ func TestAgent_CollectPsutilMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestAgent_CollectNetMetrics(t *testing.T) {
+	metricsAgent := Agent{
+		Metrics: make([]model.Metrics, 0),
+	}
+
+	metricsAgent.CollectNetMetrics()
+	assert.Empty(t, metricsAgent.Metrics, "first poll should only remember totals")
+
+	metricsAgent.CollectNetMetrics()
+	for _, metric := range metricsAgent.Metrics {
+		assert.Equal(t, model.MetricTypeCounter, metric.MType)
+		assert.NotNil(t, metric.Delta)
+	}
+}
+
+func TestAgent_setCounterFromTotal(t *testing.T) {
+	metricsAgent := Agent{
+		Metrics: make([]model.Metrics, 0),
+	}
+
+	metricsAgent.setCounterFromTotal("NetBytesSent_eth0", 100)
+	metricsAgent.setCounterFromTotal("NetBytesSent_eth0", 150)
+	metricsAgent.setCounterFromTotal("NetBytesSent_eth0", 20)
+	metricsAgent.setCounterFromTotal("NetBytesSent_eth0", 30)
+
+	if assert.Len(t, metricsAgent.Metrics, 2) {
+		assert.Equal(t, int64(50), *metricsAgent.Metrics[0].Delta)
+		assert.Equal(t, int64(10), *metricsAgent.Metrics[1].Delta)
+	}
+}
+
+func Test_metricSuffix(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "/", want: "_root"},
+		{name: "/var/lib", want: "_var_lib"},
+		{name: "eth0", want: "_eth0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, metricSuffix(test.name))
+		})
+	}
+}
+
+func TestAgent_CollectProcessMetrics(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "agent.pid")
+	err := os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matchers, err := newProcessMatchers([]config.ProcessMatcher{
+		{Name: "self", PIDFile: pidFile},
+		{Name: "missing", Pattern: "^no-such-process-name$"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metricsAgent := Agent{
+		Metrics:         make([]model.Metrics, 0),
+		processMatchers: matchers,
+	}
+
+	metricsAgent.CollectProcessMetrics()
+
+	values := make(map[string]float64)
+	for _, metric := range metricsAgent.Metrics {
+		assert.Equal(t, model.MetricTypeGauge, metric.MType)
+		values[metric.ID] = *metric.Value
+	}
+
+	assert.Equal(t, float64(1), values["ProcessCount_self"])
+	assert.Greater(t, values["ProcessRSS_self"], float64(0))
+	assert.Greater(t, values["ProcessThreads_self"], float64(0))
+	assert.Equal(t, float64(0), values["ProcessCount_missing"])
+}
+
+func Test_newProcessMatchers(t *testing.T) {
+	tests := []struct {
+		name     string
+		matchers []config.ProcessMatcher
+		wantErr  bool
+	}{
+		{name: "valid", matchers: []config.ProcessMatcher{{Name: "nginx", Pattern: "^nginx"}}},
+		{name: "no name", matchers: []config.ProcessMatcher{{Pattern: "^nginx"}}, wantErr: true},
+		{name: "no criteria", matchers: []config.ProcessMatcher{{Name: "nginx"}}, wantErr: true},
+		{name: "bad pattern", matchers: []config.ProcessMatcher{{Name: "nginx", Pattern: "("}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newProcessMatchers(test.matchers)
+			assert.Equal(t, test.wantErr, err != nil)
+		})
+	}
+}
+
+func TestAgent_CollectRuntimeMetrics(t *testing.T) {
+	metricsAgent := Agent{
+		Metrics:        make([]model.Metrics, 0),
+		runtimeSamples: newRuntimeSamples([]string{"/gc/heap/*", "/sched/goroutines:goroutines", "/sched/latencies:seconds"}),
+	}
+
+	metricsAgent.CollectRuntimeMetrics()
+	runtime.GC()
+	metricsAgent.CollectRuntimeMetrics()
+
+	tests := []struct {
+		name     string
+		metric   string
+		wantType string
+	}{
+		{name: "gauge", metric: "go_sched_goroutines_goroutines", wantType: "gauge"},
+		{name: "cumulative", metric: "go_gc_heap_allocs_bytes", wantType: "counter"},
+		{name: "histogram count", metric: "go_sched_latencies_seconds_count", wantType: "counter"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			found := false
+			for _, metric := range metricsAgent.Metrics {
+				if metric.ID == test.metric {
+					found = true
+					assert.Equal(t, metric.MType, test.wantType)
+					break
+				}
+			}
+			if !found {
+				t.Errorf("metric %s not found", test.metric)
+			}
+		})
+	}
+}
+
+func TestAgent_setHistogram(t *testing.T) {
+	metricsAgent := Agent{Metrics: make([]model.Metrics, 0)}
+	h := &metrics.Float64Histogram{Buckets: []float64{0, 1, 2, math.Inf(1)}, Counts: []uint64{100, 0, 0}}
+
+	// the first state covers the whole process lifetime, it is a baseline only
+	metricsAgent.setHistogram("latency", h)
+	assert.Empty(t, metricsAgent.Metrics)
+
+	h.Counts = []uint64{100, 0, 4}
+	metricsAgent.setHistogram("latency", h)
+	values := make(map[string]model.Metrics)
+	for _, metric := range metricsAgent.Metrics {
+		values[metric.ID] = metric
+	}
+	assert.Equal(t, int64(4), *values["latency_count"].Delta)
+	assert.Equal(t, 2.0, *values["latency_p50"].Value, "quantiles should cover observations since previous poll")
+}
+
+func Test_histogramQuantile(t *testing.T) {
+	buckets := []float64{0, 1, 2, 3, math.Inf(1)}
+	counts := []uint64{5, 3, 1, 1}
+
+	tests := []struct {
+		name string
+		q    float64
+		want float64
+	}{
+		{name: "p50", q: 0.5, want: 1},
+		{name: "p80", q: 0.8, want: 2},
+		{name: "p90", q: 0.9, want: 3},
+		{name: "max", q: 1, want: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, histogramQuantile(buckets, counts, 10, test.q))
+		})
+	}
+}
+
+func Test_compileGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "/gc/*", name: "/gc/heap/allocs:bytes", want: true},
+		{pattern: "/gc/*", name: "/sched/goroutines:goroutines", want: false},
+		{pattern: "/gc/cycles/?otal:gc-cycles", name: "/gc/cycles/total:gc-cycles", want: true},
+		{pattern: "Alloc", name: "TotalAlloc", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, compileGlob(test.pattern).MatchString(test.name))
+		})
+	}
+}
+
+func TestAgent_AddReportJob(t *testing.T) {
+	metricsAgent := Agent{
+		Metrics: make([]model.Metrics, 0),
+		StatsD:  statsd.NewAggregator(),
+	}
+
+	value := 1.5
+	metricsAgent.setRuntimeGauge("memstats", "Alloc", &value)
+	metricsAgent.SetGaugeMetric("JobSize", &value)
+	metricsAgent.StatsD.AddPacket([]byte("requests:1|c"))
+
+	jobs := make(chan []model.Metrics, 1)
+	metricsAgent.AddReportJob(context.Background(), jobs)
+
+	ids := make(map[string]bool)
+	for _, metric := range <-jobs {
+		ids[metric.ID] = true
+	}
+	assert.True(t, ids["Alloc"])
+	assert.True(t, ids["JobSize"])
+	assert.True(t, ids["requests"])
+	assert.True(t, ids["AgentQueueDepth"])
+	assert.Empty(t, metricsAgent.Metrics, "metrics should be reset after report job is added")
+
+	// runtime gauge not sampled during the next interval is reported with its last value,
+	// counters and gauges of other sources are not repeated
+	reported := func() map[string]model.Metrics {
+		metricsAgent.AddReportJob(context.Background(), jobs)
+		values := make(map[string]model.Metrics)
+		for _, metric := range <-jobs {
+			values[metric.ID] = metric
+		}
+		return values
+	}
+	values := reported()
+	require.Contains(t, values, "Alloc")
+	assert.Equal(t, 1.5, *values["Alloc"].Value)
+	assert.NotContains(t, values, "JobSize")
+	assert.NotContains(t, values, "requests")
+
+	// gauge without samples for too long is forgotten
+	for i := 1; i < gaugeIdleReports; i++ {
+		require.Contains(t, reported(), "Alloc")
+	}
+	assert.NotContains(t, reported(), "Alloc")
+
+	// gauge of disabled collector is forgotten at once
+	metricsAgent.setRuntimeGauge("memstats", "Alloc", &value)
+	reported()
+	metricsAgent.settings.collectors = map[string]bool{"runtime": true}
+	assert.NotContains(t, reported(), "Alloc")
+}
+
+func TestAgent_PushHandler(t *testing.T) {
+	metricsAgent := Agent{
+		Metrics: make([]model.Metrics, 0),
+	}
+	h := metricsAgent.PushHandler()
+
+	tests := []struct {
+		name         string
+		endpoint     string
+		payload      string
+		expectedCode int
+	}{
+		{name: "gauge", endpoint: "/update/", payload: `{"id":"JobDuration","type":"gauge","value": 1.5}`, expectedCode: 200},
+		{name: "batch", endpoint: "/updates/", payload: `[{"id":"JobRuns","type":"counter","delta": 1},{"id":"JobSize","type":"gauge","value": 10}]`, expectedCode: 200},
+		{name: "counter without delta", endpoint: "/update/", payload: `{"id":"JobRuns","type":"counter"}`, expectedCode: 400},
+		{name: "bad type", endpoint: "/updates/", payload: `[{"id":"JobRuns","type":"bad","delta": 1}]`, expectedCode: 400},
+		{name: "invalid json", endpoint: "/update/", payload: `{id:"JobRuns"}`, expectedCode: 400},
+		{name: "too large", endpoint: "/updates/", payload: "[" + strings.Repeat(" ", pushMaxBodyBytes) + "]", expectedCode: 413},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, test.endpoint, strings.NewReader(test.payload))
+			res := httptest.NewRecorder()
+
+			h.ServeHTTP(res, req)
+			assert.Equal(t, test.expectedCode, res.Code)
+		})
+	}
+
+	assert.Len(t, metricsAgent.Metrics, 3)
+}
+
+func TestAgent_pushListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{name: "localhost", address: "localhost:0"},
+		{name: "loopback ip", address: "127.0.0.1:0"},
+		{name: "public", address: "0.0.0.0:0", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metricsAgent := Agent{Config: &config.AgentConfig{PushAddress: test.address}}
+			listener, err := metricsAgent.pushListener()
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrPushAddressNotLoopback)
+				return
+			}
+			if assert.NoError(t, err) {
+				listener.Close()
+			}
+		})
+	}
+}
+
+func TestAgent_ListenPushSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "push.sock")
+	metricsAgent := Agent{Config: &config.AgentConfig{PushSocket: socket}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- metricsAgent.ListenPush(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+	assert.NoFileExists(t, socket)
+}
+
+func TestScraper_scrape(t *testing.T) {
+	total := 10
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE jobs_total counter\njobs_total %d\n# TYPE queue gauge\nqueue{name=\"main\"} 3\nnoisy_metric 1\n", total)
+	}))
+	defer srv.Close()
+
+	scrapers, err := newScrapers([]config.ScrapeTarget{{
+		Name: "app",
+		URL:  srv.URL,
+		Relabel: []config.RelabelRule{
+			{Regex: "^noisy_.*", Action: "drop"},
+			{Regex: "^(.*)$", Replacement: "app_$1"},
+		},
+	}}, 1)
+	require.NoError(t, err)
+	s := scrapers[0]
+
+	metrics, err := s.scrape(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "app_queue;name=main", metrics[0].ID)
+	assert.Equal(t, model.MetricTypeGauge, metrics[0].MType)
+
+	total = 15
+	metrics, err = s.scrape(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "app_jobs_total", metrics[0].ID)
+	assert.Equal(t, int64(5), *metrics[0].Delta)
+}
+
+func Test_limitID(t *testing.T) {
+	assert.Equal(t, "http_requests;code=200", limitID("http_requests;code=200"))
+
+	long := "http_requests;path=/" + strings.Repeat("é", model.MaxIDLength)
+	id := limitID(long)
+	assert.LessOrEqual(t, len(id), model.MaxIDLength)
+	assert.True(t, utf8.ValidString(id))
+	assert.True(t, strings.HasPrefix(id, "http_requests;path=/"))
+	assert.Equal(t, id, limitID(long))
+	assert.NotEqual(t, id, limitID(long+"x"))
+}
+
+func Test_newScrapers(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []config.ScrapeTarget
+		wantErr bool
+	}{
+		{name: "valid", targets: []config.ScrapeTarget{{URL: "http://localhost:9100/metrics"}}},
+		{name: "no url", targets: []config.ScrapeTarget{{Name: "app"}}, wantErr: true},
+		{name: "bad regex", targets: []config.ScrapeTarget{{URL: "http://localhost", Relabel: []config.RelabelRule{{Regex: "("}}}}, wantErr: true},
+		{name: "bad action", targets: []config.ScrapeTarget{{URL: "http://localhost", Relabel: []config.RelabelRule{{Regex: ".*", Action: "keep"}}}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newScrapers(test.targets, 2)
+			assert.Equal(t, test.wantErr, err != nil)
+		})
+	}
+}
+
+func TestAgent_deliver(t *testing.T) {
+	newServer := func(status int, received *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/updates/" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			received.Add(1)
+			w.WriteHeader(status)
+		}))
+	}
+
+	value := 1.5
+	metrics := []model.Metrics{{ID: "Alloc", MType: model.MetricTypeGauge, Value: &value}}
+
+	t.Run("failover", func(t *testing.T) {
+		var first, second atomic.Int32
+		broken := newServer(http.StatusInternalServerError, &first)
+		defer broken.Close()
+		healthy := newServer(http.StatusOK, &second)
+		defer healthy.Close()
+
+		cfg := &config.AgentConfig{ReportRetryCount: 1, DeliveryMode: config.DeliveryModeFailover}
+		metricsAgent := Agent{Config: cfg, Client: http.DefaultClient}
+		metricsAgent.servers = metricsAgent.newServerTargets([]string{broken.Listener.Addr().String(), healthy.Listener.Addr().String()})
+
+		require.NoError(t, metricsAgent.deliver(context.Background(), metrics))
+		require.NoError(t, metricsAgent.deliver(context.Background(), metrics))
+		assert.Equal(t, int32(1), first.Load(), "unhealthy server should be skipped after failure")
+		assert.Equal(t, int32(2), second.Load())
+	})
+
+	t.Run("fan-out", func(t *testing.T) {
+		var first, second atomic.Int32
+		broken := newServer(http.StatusInternalServerError, &first)
+		defer broken.Close()
+		healthy := newServer(http.StatusOK, &second)
+		defer healthy.Close()
+
+		cfg := &config.AgentConfig{ReportRetryCount: 1, DeliveryMode: config.DeliveryModeFanOut}
+		metricsAgent := Agent{Config: cfg, Client: http.DefaultClient}
+		metricsAgent.servers = metricsAgent.newServerTargets([]string{broken.Listener.Addr().String(), healthy.Listener.Addr().String()})
+
+		err := metricsAgent.deliver(context.Background(), metrics)
+		assert.ErrorIs(t, err, ErrStatus)
+		assert.Equal(t, int32(1), first.Load())
+		assert.Equal(t, int32(1), second.Load())
+	})
+
+	t.Run("fan-out spool", func(t *testing.T) {
+		var down atomic.Bool
+		var received []string
+		flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/updates/" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if down.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			zr, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			var batch []model.Metrics
+			require.NoError(t, json.NewDecoder(zr).Decode(&batch))
+			for _, metric := range batch {
+				received = append(received, metric.ID)
+			}
+		}))
+		defer flaky.Close()
+
+		cfg := &config.AgentConfig{DeliveryMode: config.DeliveryModeFanOut, SpoolMaxBytes: 1024}
+		metricsAgent := Agent{Config: cfg, Client: http.DefaultClient}
+		metricsAgent.servers = metricsAgent.newServerTargets([]string{flaky.Listener.Addr().String()})
+
+		down.Store(true)
+		require.NoError(t, metricsAgent.deliver(context.Background(), metrics))
+		assert.Empty(t, received)
+		assert.Equal(t, int64(metricSize(metrics[0])), metricsAgent.stats.spooledBytes.Load())
+
+		// spool is drained with the next successful send
+		down.Store(false)
+		next := []model.Metrics{{ID: "Sys", MType: model.MetricTypeGauge, Value: &value}}
+		require.NoError(t, metricsAgent.deliver(context.Background(), next))
+		assert.Equal(t, []string{"Alloc", "Sys"}, received)
+		assert.Zero(t, metricsAgent.stats.spooledBytes.Load())
+		assert.Empty(t, metricsAgent.servers[0].takeSpool())
+	})
+}
+
+func TestServerTarget_addSpool(t *testing.T) {
+	target := &serverTarget{}
+	value := 1.0
+	metric := func(id string) model.Metrics {
+		return model.Metrics{ID: id, MType: model.MetricTypeGauge, Value: &value}
+	}
+	size := metricSize(metric("a"))
+
+	spooled, dropped := target.addSpool([]model.Metrics{metric("b"), metric("c")}, 2*size)
+	assert.Equal(t, 2, spooled)
+	assert.Equal(t, 0, dropped)
+
+	// older metrics go first and are dropped first
+	spooled, dropped = target.addSpool([]model.Metrics{metric("a")}, 2*size)
+	assert.Equal(t, 2, spooled)
+	assert.Equal(t, 1, dropped)
+
+	ids := []string{}
+	for _, m := range target.takeSpool() {
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []string{"b", "c"}, ids)
+}
+
+func TestAgentConfig_ServerAddresses(t *testing.T) {
+	cfg := config.AgentConfig{Address: "localhost:8080, localhost:8081,"}
+	assert.Equal(t, []string{"localhost:8080", "localhost:8081"}, cfg.ServerAddresses())
+}
+
+func TestAgent_prepareBatches(t *testing.T) {
+	metricsAgent := Agent{Config: &config.AgentConfig{}}
+
+	metrics := make([]model.Metrics, 10)
+	for i := range metrics {
+		value := float64(i)
+		metrics[i] = model.Metrics{ID: fmt.Sprintf("Metric%d", i), MType: model.MetricTypeGauge, Value: &value}
+	}
+
+	tests := []struct {
+		name      string
+		limits    model.Limits
+		wantCount []int
+	}{
+		{name: "unlimited", limits: model.Limits{}, wantCount: []int{10}},
+		{name: "by count", limits: model.Limits{MaxBatchSize: 4}, wantCount: []int{4, 4, 2}},
+		{name: "by bytes", limits: model.Limits{MaxBatchBytes: 1}, wantCount: []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batches, err := metricsAgent.prepareBatches(client.New("localhost:8080"), metrics, test.limits)
+			require.NoError(t, err)
+
+			var counts []int
+			for _, b := range batches {
+				counts = append(counts, b.Count)
+			}
+			assert.Equal(t, test.wantCount, counts)
+		})
+	}
+}
+
+func TestAgent_reportMetricsWithRetry_ServerLimits(t *testing.T) {
+	var batchSizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/limits" {
+			w.Write([]byte(`{"max_batch_size": 2}`))
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var metrics []model.Metrics
+		require.NoError(t, json.NewDecoder(zr).Decode(&metrics))
+		batchSizes = append(batchSizes, len(metrics))
+	}))
+	defer srv.Close()
+
+	metricsAgent := Agent{Config: &config.AgentConfig{ReportRetryCount: 1, MaxBatchSize: 3}, Client: http.DefaultClient}
+	target := metricsAgent.newServerTargets([]string{srv.Listener.Addr().String()})[0]
+
+	delta := int64(1)
+	metrics := []model.Metrics{
+		{ID: "a", MType: model.MetricTypeCounter, Delta: &delta},
+		{ID: "b", MType: model.MetricTypeCounter, Delta: &delta},
+		{ID: "c", MType: model.MetricTypeCounter, Delta: &delta},
+	}
+
+	sent, err := metricsAgent.reportMetricsWithRetry(context.Background(), target, metrics)
+	require.NoError(t, err)
+	assert.Equal(t, 3, sent)
+	assert.Equal(t, []int{2, 1}, batchSizes)
+}
+
+func TestAgent_selfStats(t *testing.T) {
+	metricsAgent := Agent{Config: &config.AgentConfig{}}
+
+	metricsAgent.collect("test", func() {})
+	metricsAgent.stats.batchesSent.Add(2)
+	metricsAgent.stats.batchesDropped.Add(1)
+	metricsAgent.stats.spooledBytes.Store(512)
+
+	values := make(map[string]model.Metrics)
+	for _, metric := range metricsAgent.stats.metrics() {
+		values[metric.ID] = metric
+	}
+	assert.Equal(t, int64(2), *values["AgentBatchesSent"].Delta)
+	assert.Equal(t, int64(1), *values["AgentBatchesDropped"].Delta)
+	assert.Contains(t, values, "AgentCollectDuration_test")
+	assert.Equal(t, 512.0, *values["AgentSpooledBytes"].Value)
+
+	metricsAgent.stats.batchesSent.Add(1)
+	for _, metric := range metricsAgent.stats.metrics() {
+		if metric.ID == "AgentBatchesSent" {
+			assert.Equal(t, int64(1), *metric.Delta, "counters should be reported as delta")
+		}
+	}
+
+	res := httptest.NewRecorder()
+	metricsAgent.SelfMetricsHandler().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "agent_batches_sent_total 3\n")
+	assert.Contains(t, res.Body.String(), "agent_spooled_bytes 512\n")
+	assert.Contains(t, res.Body.String(), `agent_collect_duration_seconds{collector="test"}`)
+}
+
+func TestAgent_RemoteSettings(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/agent/settings", r.URL.Path)
+		assert.Equal(t, "host1", r.URL.Query().Get("id"))
+		w.Write([]byte(`{"poll_interval": 1, "report_interval": 5, "collectors": ["memory"]}`))
+	}))
+	defer srv.Close()
+
+	cfg := &config.AgentConfig{Address: srv.Listener.Addr().String(), ID: "host1", PollInterval: 2, ReportInterval: 10}
+	metricsAgent := Agent{
+		Config:          cfg,
+		Client:          http.DefaultClient,
+		settingsUpdates: make(chan struct{}, 1),
+	}
+	metricsAgent.servers = metricsAgent.newServerTargets(cfg.ServerAddresses())
+
+	poll, report := metricsAgent.Intervals()
+	assert.Equal(t, 2*time.Second, poll)
+	assert.Equal(t, 10*time.Second, report)
+
+	metricsAgent.updateSettings(context.Background())
+
+	select {
+	case <-metricsAgent.SettingsUpdates():
+	default:
+		t.Fatal("settings update is not notified")
+	}
+	poll, report = metricsAgent.Intervals()
+	assert.Equal(t, time.Second, poll)
+	assert.Equal(t, 5*time.Second, report)
+	assert.True(t, metricsAgent.collectorEnabled("memory"))
+	assert.False(t, metricsAgent.collectorEnabled("cpu"))
+}
+
+func TestAgent_ApplySettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings model.AgentSettings
+		wantErr  bool
+	}{
+		{name: "valid", settings: model.AgentSettings{PollInterval: 1, Collectors: []string{"cpu", "net"}}},
+		{name: "negative interval", settings: model.AgentSettings{ReportInterval: -1}, wantErr: true},
+		{name: "unknown collector", settings: model.AgentSettings{Collectors: []string{"gpu"}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metricsAgent := Agent{Config: &config.AgentConfig{}}
+			err := metricsAgent.ApplySettings(test.settings)
+			if test.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidSettings)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestMetricFilter_apply(t *testing.T) {
+	filter, err := newMetricFilter(model.MetricFilter{
+		Allow:  []string{"Disk*", "/^Net(Bytes|Packets)Recv_.*$/", "Alloc"},
+		Deny:   []string{"*_loop*"},
+		Rename: []model.RenameRule{{Regex: "^Net(.*)Recv_(.*)$", Replacement: "${2}_received_$1"}},
+		Prefix: "host1.",
+	})
+	require.NoError(t, err)
+
+	delta := int64(1)
+	value := 1.5
+	metrics := []model.Metrics{
+		{ID: "Alloc", MType: model.MetricTypeGauge, Value: &value},
+		{ID: "TotalAlloc", MType: model.MetricTypeGauge, Value: &value},
+		{ID: "DiskFree_root", MType: model.MetricTypeGauge, Value: &value},
+		{ID: "DiskReadBytes_loop0", MType: model.MetricTypeCounter, Delta: &delta},
+		{ID: "NetBytesRecv_eth0", MType: model.MetricTypeCounter, Delta: &delta},
+		{ID: "NetBytesSent_eth0", MType: model.MetricTypeCounter, Delta: &delta},
+	}
+
+	var ids []string
+	for _, metric := range filter.apply(metrics) {
+		ids = append(ids, metric.ID)
+	}
+	assert.Equal(t, []string{"host1.Alloc", "host1.DiskFree_root", "host1.eth0_received_Bytes"}, ids)
+}
+
+func Test_newMetricFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  model.MetricFilter
+		wantErr bool
+	}{
+		{name: "empty", filter: model.MetricFilter{}},
+		{name: "bad allow regex", filter: model.MetricFilter{Allow: []string{"/(/"}}, wantErr: true},
+		{name: "bad rename regex", filter: model.MetricFilter{Rename: []model.RenameRule{{Regex: "("}}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newMetricFilter(test.filter)
+			assert.Equal(t, test.wantErr, err != nil)
+		})
+	}
+}
+
+func TestGaugeAggregator_apply(t *testing.T) {
+	aggregator, err := newGaugeAggregator(AggregationLast, []config.AggregationRule{
+		{Pattern: "CPU*", Mode: AggregationMax},
+		{Pattern: "Load*", Mode: AggregationAll},
+		{Pattern: "Random*", Mode: AggregationNone},
+	})
+	require.NoError(t, err)
+
+	gauge := func(id string, value float64) model.Metrics {
+		return model.Metrics{ID: id, MType: model.MetricTypeGauge, Value: &value}
+	}
+	delta := int64(1)
+	metrics := []model.Metrics{
+		gauge("Alloc", 1), gauge("CPUutilization1", 50), gauge("LoadAverage1", 2), gauge("RandomValue", 0.1),
+		{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta},
+		gauge("Alloc", 3), gauge("CPUutilization1", 90), gauge("LoadAverage1", 4), gauge("RandomValue", 0.2),
+		{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta},
+		gauge("Alloc", 2), gauge("CPUutilization1", 10), gauge("LoadAverage1", 6),
+	}
+
+	var got []string
+	for _, metric := range aggregator.apply(metrics) {
+		if metric.MType == model.MetricTypeGauge {
+			got = append(got, fmt.Sprintf("%s=%g", metric.ID, *metric.Value))
+		} else {
+			got = append(got, fmt.Sprintf("%s+%d", metric.ID, *metric.Delta))
+		}
+	}
+
+	assert.Equal(t, []string{
+		"Alloc=2",
+		"CPUutilization1=90",
+		"LoadAverage1=6", "LoadAverage1_min=2", "LoadAverage1_max=6", "LoadAverage1_avg=4",
+		"RandomValue=0.1",
+		"PollCount+1",
+		"RandomValue=0.2",
+		"PollCount+1",
+	}, got)
+}
+
+func Test_newGaugeAggregator(t *testing.T) {
+	_, err := newGaugeAggregator("median", nil)
+	assert.Error(t, err)
+
+	_, err = newGaugeAggregator("", []config.AggregationRule{{Pattern: "*", Mode: "sum"}})
+	assert.Error(t, err)
+}
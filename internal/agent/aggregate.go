@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+const (
+	AggregationNone = "none"
+	AggregationLast = "last"
+	AggregationMin  = "min"
+	AggregationMax  = "max"
+	AggregationAvg  = "avg"
+	AggregationAll  = "all"
+)
+
+type aggregationRule struct {
+	pattern *regexp.Regexp
+	mode    string
+}
+
+// gaugeAggregator reduces gauge samples collected over report window
+type gaugeAggregator struct {
+	defaultMode string
+	rules       []aggregationRule
+}
+
+type gaugeWindow struct {
+	last  float64
+	min   float64
+	max   float64
+	sum   float64
+	count int
+}
+
+// newGaugeAggregator
+// validates aggregation modes and compiles rule patterns
+func newGaugeAggregator(defaultMode string, rules []config.AggregationRule) (*gaugeAggregator, error) {
+	if defaultMode == "" {
+		defaultMode = AggregationLast
+	}
+	if !validAggregationMode(defaultMode) {
+		return nil, fmt.Errorf("unknown aggregation mode '%s'", defaultMode)
+	}
+
+	ga := &gaugeAggregator{defaultMode: defaultMode}
+	for _, rule := range rules {
+		if !validAggregationMode(rule.Mode) {
+			return nil, fmt.Errorf("unknown aggregation mode '%s'", rule.Mode)
+		}
+		patterns, err := compilePatterns([]string{rule.Pattern})
+		if err != nil {
+			return nil, fmt.Errorf("aggregation pattern: %w", err)
+		}
+		ga.rules = append(ga.rules, aggregationRule{pattern: patterns[0], mode: rule.Mode})
+	}
+
+	return ga, nil
+}
+
+// apply
+// replaces gauge samples of every metric with aggregated values, keeping order of first appearance.
+// Counters and metrics with "none" mode are passed as is
+func (ga *gaugeAggregator) apply(metrics []model.Metrics) []model.Metrics {
+	if ga == nil {
+		return metrics
+	}
+
+	type entry struct {
+		metric model.Metrics
+		window *gaugeWindow
+	}
+
+	windows := make(map[string]*gaugeWindow)
+	entries := make([]entry, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.MType != model.MetricTypeGauge || metric.Value == nil || ga.mode(metric.ID) == AggregationNone {
+			entries = append(entries, entry{metric: metric})
+			continue
+		}
+
+		value := *metric.Value
+		w, ok := windows[metric.ID]
+		if !ok {
+			w = &gaugeWindow{min: value, max: value}
+			windows[metric.ID] = w
+			entries = append(entries, entry{metric: metric, window: w})
+		}
+
+		w.last = value
+		w.min = math.Min(w.min, value)
+		w.max = math.Max(w.max, value)
+		w.sum += value
+		w.count++
+	}
+
+	result := make([]model.Metrics, 0, len(entries))
+	for _, e := range entries {
+		if e.window == nil {
+			result = append(result, e.metric)
+			continue
+		}
+		result = append(result, e.window.metrics(e.metric.ID, ga.mode(e.metric.ID))...)
+	}
+
+	return result
+}
+
+func (ga *gaugeAggregator) mode(id string) string {
+	for _, rule := range ga.rules {
+		if rule.pattern.MatchString(id) {
+			return rule.mode
+		}
+	}
+
+	return ga.defaultMode
+}
+
+// metrics
+// returns aggregated value, "all" mode reports last value under original ID and min, max, avg as separate series
+func (w *gaugeWindow) metrics(id string, mode string) []model.Metrics {
+	gauge := func(id string, value float64) model.Metrics {
+		return model.Metrics{ID: id, MType: model.MetricTypeGauge, Value: &value}
+	}
+	avg := w.sum / float64(w.count)
+
+	switch mode {
+	case AggregationMin:
+		return []model.Metrics{gauge(id, w.min)}
+	case AggregationMax:
+		return []model.Metrics{gauge(id, w.max)}
+	case AggregationAvg:
+		return []model.Metrics{gauge(id, avg)}
+	case AggregationAll:
+		return []model.Metrics{
+			gauge(id, w.last),
+			gauge(id+"_min", w.min),
+			gauge(id+"_max", w.max),
+			gauge(id+"_avg", avg),
+		}
+	}
+
+	return []model.Metrics{gauge(id, w.last)}
+}
+
+func validAggregationMode(mode string) bool {
+	switch mode {
+	case AggregationNone, AggregationLast, AggregationMin, AggregationMax, AggregationAvg, AggregationAll:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/pkg/client"
+)
+
+// prepareBatches
+// splits metrics into batches with at most limits.MaxBatchSize metrics
+// and at most limits.MaxBatchBytes of compressed data, zero limit means no limit
+func (agent *Agent) prepareBatches(c *client.Client, metrics []model.Metrics, limits model.Limits) ([]*client.Batch, error) {
+	var batches []*client.Batch
+	for len(metrics) > 0 {
+		n := len(metrics)
+		if limits.MaxBatchSize > 0 && n > limits.MaxBatchSize {
+			n = limits.MaxBatchSize
+		}
+
+		encoded, err := encodeBatch(c, metrics[:n], limits.MaxBatchBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		batches = append(batches, encoded...)
+		metrics = metrics[n:]
+	}
+
+	return batches, nil
+}
+
+// encodeBatch
+// encodes metrics, halving them until compressed data fits maxBytes.
+// Single metric is sent as is even if it exceeds the limit
+func encodeBatch(c *client.Client, metrics []model.Metrics, maxBytes int) ([]*client.Batch, error) {
+	b, err := c.EncodeBatch(metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxBytes > 0 && b.CompressedSize > maxBytes && len(metrics) > 1 {
+		half := len(metrics) / 2
+		left, err := encodeBatch(c, metrics[:half], maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		right, err := encodeBatch(c, metrics[half:], maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		return append(left, right...), nil
+	}
+
+	return []*client.Batch{b}, nil
+}
+
+// targetLimits
+// returns the strictest of configured limits and limits advertised by server, server is asked only once
+func (agent *Agent) targetLimits(ctx context.Context, target *serverTarget) model.Limits {
+	target.mu.Lock()
+	fetched := target.limitsFetched
+	target.mu.Unlock()
+
+	if !fetched {
+		agent.refreshLimits(ctx, target)
+	}
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	return model.Limits{
+		MaxBatchSize:  minLimit(agent.Config.MaxBatchSize, target.limits.MaxBatchSize),
+		MaxBatchBytes: minLimit(agent.Config.MaxBatchBytes, target.limits.MaxBatchBytes),
+	}
+}
+
+// refreshLimits
+// requests limits advertised by server, servers without limits endpoint are treated as unlimited
+func (agent *Agent) refreshLimits(ctx context.Context, target *serverTarget) {
+	limits, err := target.client.Limits(ctx)
+	if err != nil {
+		logger.Log.Debug("fetch server limits error", zap.String("address", target.address), zap.Error(err))
+	}
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	target.limits = limits
+	// connection errors are not cached, so limits are requested again with the next batch
+	target.limitsFetched = err == nil || errors.Is(err, ErrStatus)
+}
+
+func minLimit(a, b int) int {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 || a < b {
+		return a
+	}
+
+	return b
+}
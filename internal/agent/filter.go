@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// metricFilter is compiled model.MetricFilter
+type metricFilter struct {
+	allow  []*regexp.Regexp
+	deny   []*regexp.Regexp
+	rename []relabelRule
+	prefix string
+}
+
+// newMetricFilter
+// compiles filter patterns and rename rules
+func newMetricFilter(f model.MetricFilter) (*metricFilter, error) {
+	mf := &metricFilter{prefix: f.Prefix}
+
+	var err error
+	if mf.allow, err = compilePatterns(f.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if mf.deny, err = compilePatterns(f.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+
+	for _, rule := range f.Rename {
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("rename: %w", err)
+		}
+		mf.rename = append(mf.rename, relabelRule{regex: re, replacement: rule.Replacement})
+	}
+
+	return mf, nil
+}
+
+// apply
+// drops denied and not allowed metrics and renames the rest, metrics slice is filtered in place
+func (mf *metricFilter) apply(metrics []model.Metrics) []model.Metrics {
+	if mf == nil {
+		return metrics
+	}
+
+	result := metrics[:0]
+	for _, metric := range metrics {
+		if !mf.allowed(metric.ID) {
+			continue
+		}
+
+		for _, rule := range mf.rename {
+			metric.ID = rule.regex.ReplaceAllString(metric.ID, rule.replacement)
+		}
+		metric.ID = mf.prefix + metric.ID
+
+		if metric.ID != "" {
+			result = append(result, metric)
+		}
+	}
+
+	return result
+}
+
+func (mf *metricFilter) allowed(id string) bool {
+	for _, re := range mf.deny {
+		if re.MatchString(id) {
+			return false
+		}
+	}
+
+	if len(mf.allow) == 0 {
+		return true
+	}
+	for _, re := range mf.allow {
+		if re.MatchString(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compilePatterns
+// compiles globs and regular expressions wrapped in slashes
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, re)
+			continue
+		}
+		result = append(result, compileGlob(pattern))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/logger"
+)
+
+type processMatcher struct {
+	name    string
+	pidFile string
+	pattern *regexp.Regexp
+	cgroup  string
+}
+
+type processStats struct {
+	count      int
+	rss        uint64
+	cpuSeconds float64
+	fds        int64
+	threads    int64
+	startedAt  int64
+}
+
+// newProcessMatchers
+// validates process matchers from config and compiles their patterns
+func newProcessMatchers(matchers []config.ProcessMatcher) ([]processMatcher, error) {
+	result := make([]processMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		if m.Name == "" {
+			return nil, fmt.Errorf("process matcher without name")
+		}
+		if m.PIDFile == "" && m.Pattern == "" && m.Cgroup == "" {
+			return nil, fmt.Errorf("process matcher '%s' has no criteria", m.Name)
+		}
+
+		pm := processMatcher{name: m.Name, pidFile: m.PIDFile, cgroup: m.Cgroup}
+		if m.Pattern != "" {
+			re, err := regexp.Compile(m.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("process matcher '%s' pattern: %w", m.Name, err)
+			}
+			pm.pattern = re
+		}
+
+		result = append(result, pm)
+	}
+
+	return result, nil
+}
+
+// CollectProcessMetrics
+// Collect RSS, CPU time, open file descriptors, threads and uptime of configured processes
+func (agent *Agent) CollectProcessMetrics() {
+	if len(agent.processMatchers) == 0 {
+		return
+	}
+
+	var all []*process.Process
+	for _, m := range agent.processMatchers {
+		if m.pattern != nil || m.cgroup != "" {
+			var err error
+			all, err = process.Processes()
+			if err != nil {
+				logger.Log.Error("list processes error", zap.Error(err))
+			}
+			break
+		}
+	}
+
+	now := time.Now()
+	for _, m := range agent.processMatchers {
+		stats := processStats{}
+		for _, p := range m.match(all) {
+			stats.add(p)
+		}
+
+		suffix := metricSuffix(m.name)
+		count := float64(stats.count)
+		rss := float64(stats.rss)
+		cpuSeconds := stats.cpuSeconds
+		fds := float64(stats.fds)
+		threads := float64(stats.threads)
+		var uptime float64
+		if stats.startedAt > 0 {
+			uptime = now.Sub(time.UnixMilli(stats.startedAt)).Seconds()
+		}
+
+		agent.SetGaugeMetric("ProcessCount"+suffix, &count)
+		agent.SetGaugeMetric("ProcessRSS"+suffix, &rss)
+		agent.SetGaugeMetric("ProcessCPUSeconds"+suffix, &cpuSeconds)
+		agent.SetGaugeMetric("ProcessOpenFDs"+suffix, &fds)
+		agent.SetGaugeMetric("ProcessThreads"+suffix, &threads)
+		agent.SetGaugeMetric("ProcessUptime"+suffix, &uptime)
+	}
+}
+
+// match
+// returns processes satisfying matcher, every process is returned once
+func (m processMatcher) match(all []*process.Process) []*process.Process {
+	matched := make(map[int32]*process.Process)
+
+	if m.pidFile != "" {
+		pid, err := readPIDFile(m.pidFile)
+		if err != nil {
+			logger.Log.Debug("read pid file error", zap.String("path", m.pidFile), zap.Error(err))
+		} else if p, err := process.NewProcess(pid); err == nil {
+			matched[p.Pid] = p
+		}
+	}
+
+	if m.pattern != nil || m.cgroup != "" {
+		for _, p := range all {
+			if _, ok := matched[p.Pid]; ok {
+				continue
+			}
+			if m.matchPattern(p) || m.matchCgroup(p.Pid) {
+				matched[p.Pid] = p
+			}
+		}
+	}
+
+	result := make([]*process.Process, 0, len(matched))
+	for _, p := range matched {
+		result = append(result, p)
+	}
+
+	return result
+}
+
+func (m processMatcher) matchPattern(p *process.Process) bool {
+	if m.pattern == nil {
+		return false
+	}
+
+	if name, err := p.Name(); err == nil && m.pattern.MatchString(name) {
+		return true
+	}
+	if cmdline, err := p.Cmdline(); err == nil && cmdline != "" && m.pattern.MatchString(cmdline) {
+		return true
+	}
+
+	return false
+}
+
+// matchCgroup
+// checks if process belongs to configured cgroup or any of its children, works on linux only
+func (m processMatcher) matchCgroup(pid int32) bool {
+	if m.cgroup == "" {
+		return false
+	}
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// line format is hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		path := parts[2]
+		if path == m.cgroup || strings.HasPrefix(path, strings.TrimSuffix(m.cgroup, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *processStats) add(p *process.Process) {
+	s.count++
+
+	if mem, err := p.MemoryInfo(); err == nil {
+		s.rss += mem.RSS
+	}
+	if times, err := p.Times(); err == nil {
+		s.cpuSeconds += times.User + times.System
+	}
+	if fds, err := p.NumFDs(); err == nil {
+		s.fds += int64(fds)
+	}
+	if threads, err := p.NumThreads(); err == nil {
+		s.threads += int64(threads)
+	}
+	if createTime, err := p.CreateTime(); err == nil && (s.startedAt == 0 || createTime < s.startedAt) {
+		s.startedAt = createTime
+	}
+}
+
+func readPIDFile(path string) (int32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid in '%s': %w", path, err)
+	}
+
+	return int32(pid), nil
+}
@@ -0,0 +1,177 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/handler/middlewares"
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// pushMaxBodyBytes limits size of pushed request body after decompression
+const pushMaxBodyBytes = 1 << 20
+
+var (
+	ErrPushAddressNotLoopback = errors.New("push address must be loopback")
+	ErrInvalidPushMetric      = errors.New("invalid metric")
+)
+
+// PushHandler
+// returns handler accepting metrics in the same json format as server's /update/ and /updates/ endpoints
+func (agent *Agent) PushHandler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(middlewares.GzipMiddleware)
+	r.Post("/update/", agent.pushUpdateHandler)
+	r.Post("/updates/", agent.pushBatchUpdateHandler)
+
+	return r
+}
+
+// ListenPush
+// serves local push API on loopback address or unix socket until context is done
+func (agent *Agent) ListenPush(ctx context.Context) error {
+	listener, err := agent.pushListener()
+	if err != nil {
+		return err
+	}
+	if agent.Config.PushSocket != "" {
+		defer os.Remove(agent.Config.PushSocket)
+	}
+
+	srv := &http.Server{Handler: agent.PushHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Log.Info("Push API started", zap.String("address", listener.Addr().String()))
+	err = srv.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (agent *Agent) pushListener() (net.Listener, error) {
+	if agent.Config.PushSocket != "" {
+		if err := os.Remove(agent.Config.PushSocket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", agent.Config.PushSocket)
+	}
+
+	host, _, err := net.SplitHostPort(agent.Config.PushAddress)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("%w: %s", ErrPushAddressNotLoopback, agent.Config.PushAddress)
+		}
+	}
+
+	return net.Listen("tcp", agent.Config.PushAddress)
+}
+
+func (agent *Agent) pushUpdateHandler(res http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	var metric model.Metrics
+	if err := decodePushBody(res, req, &metric); err != nil {
+		http.Error(res, err.Error(), pushErrorStatus(err))
+		return
+	}
+
+	if err := agent.PushMetrics([]model.Metrics{metric}); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+func (agent *Agent) pushBatchUpdateHandler(res http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	var metrics []model.Metrics
+	if err := decodePushBody(res, req, &metrics); err != nil {
+		http.Error(res, err.Error(), pushErrorStatus(err))
+		return
+	}
+
+	if err := agent.PushMetrics(metrics); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+// decodePushBody
+// decodes json body limited by pushMaxBodyBytes
+func decodePushBody(res http.ResponseWriter, req *http.Request, v any) error {
+	return json.NewDecoder(http.MaxBytesReader(res, req.Body, pushMaxBodyBytes)).Decode(v)
+}
+
+// pushErrorStatus
+// returns 413 for body exceeding limit and 400 for other decoding errors
+func pushErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
+
+// PushMetrics
+// validates metrics pushed by applications and buffers them until next report
+func (agent *Agent) PushMetrics(metrics []model.Metrics) error {
+	for _, metric := range metrics {
+		if err := validatePushMetric(metric); err != nil {
+			return err
+		}
+	}
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	agent.Metrics = append(agent.Metrics, metrics...)
+
+	return nil
+}
+
+func validatePushMetric(metric model.Metrics) error {
+	if metric.ID == "" {
+		return fmt.Errorf("%w: empty id", ErrInvalidPushMetric)
+	}
+
+	switch metric.MType {
+	case model.MetricTypeGauge:
+		if metric.Value == nil {
+			return fmt.Errorf("%w: gauge '%s' without value", ErrInvalidPushMetric, metric.ID)
+		}
+	case model.MetricTypeCounter:
+		if metric.Delta == nil {
+			return fmt.Errorf("%w: counter '%s' without delta", ErrInvalidPushMetric, metric.ID)
+		}
+	default:
+		return fmt.Errorf("%w: unknown type '%s'", ErrInvalidPushMetric, metric.MType)
+	}
+
+	return nil
+}
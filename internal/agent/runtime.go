@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"math"
+	"regexp"
+	"runtime/metrics"
+	"strings"
+)
+
+// histogramQuantiles are reported for every runtime histogram as separate gauges
+var histogramQuantiles = []struct {
+	suffix string
+	q      float64
+}{
+	{suffix: "_p50", q: 0.5},
+	{suffix: "_p90", q: 0.9},
+	{suffix: "_p99", q: 0.99},
+	{suffix: "_max", q: 1},
+}
+
+type runtimeSamples struct {
+	samples    []metrics.Sample
+	cumulative map[string]bool
+}
+
+// newRuntimeSamples
+// selects runtime/metrics samples whose names match any of glob patterns
+func newRuntimeSamples(patterns []string) *runtimeSamples {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	matchers := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		matchers = append(matchers, compileGlob(pattern))
+	}
+
+	rs := &runtimeSamples{cumulative: make(map[string]bool)}
+	for _, d := range metrics.All() {
+		for _, m := range matchers {
+			if m.MatchString(d.Name) {
+				rs.samples = append(rs.samples, metrics.Sample{Name: d.Name})
+				rs.cumulative[d.Name] = d.Cumulative
+				break
+			}
+		}
+	}
+
+	return rs
+}
+
+// CollectRuntimeMetrics
+// Collect selected runtime/metrics samples without stopping the world.
+// Cumulative integer samples are sent as counters, other scalar samples as gauges,
+// histograms are reported as quantiles and count of observations since previous poll
+func (agent *Agent) CollectRuntimeMetrics() {
+	if agent.runtimeSamples == nil {
+		return
+	}
+
+	metrics.Read(agent.runtimeSamples.samples)
+
+	for _, sample := range agent.runtimeSamples.samples {
+		name := runtimeMetricName(sample.Name)
+
+		switch sample.Value.Kind() {
+		case metrics.KindUint64:
+			if agent.runtimeSamples.cumulative[sample.Name] {
+				agent.setCounterFromTotal(name, sample.Value.Uint64())
+				continue
+			}
+			value := float64(sample.Value.Uint64())
+			agent.setRuntimeGauge("runtime", name, &value)
+		case metrics.KindFloat64:
+			value := sample.Value.Float64()
+			agent.setRuntimeGauge("runtime", name, &value)
+		case metrics.KindFloat64Histogram:
+			agent.setHistogram(name, sample.Value.Float64Histogram())
+		}
+	}
+}
+
+// setHistogram
+// computes difference between current and previous state of cumulative histogram
+// and reports its quantiles and observations count. The first state is only kept as a baseline,
+// since it covers the whole process lifetime rather than poll interval
+func (agent *Agent) setHistogram(name string, h *metrics.Float64Histogram) {
+	agent.mu.Lock()
+	if agent.histograms == nil {
+		agent.histograms = make(map[string][]uint64)
+	}
+	prev, ok := agent.histograms[name]
+	current := make([]uint64, len(h.Counts))
+	copy(current, h.Counts)
+	agent.histograms[name] = current
+	agent.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	delta := make([]uint64, len(current))
+	var total uint64
+	for i := range current {
+		delta[i] = current[i]
+		if len(prev) == len(current) && current[i] >= prev[i] {
+			delta[i] -= prev[i]
+		}
+		total += delta[i]
+	}
+
+	count := int64(total)
+	agent.SetCounterMetric(name+"_count", &count)
+
+	if total == 0 {
+		return
+	}
+
+	for _, quantile := range histogramQuantiles {
+		value := histogramQuantile(h.Buckets, delta, total, quantile.q)
+		agent.SetGaugeMetric(name+quantile.suffix, &value)
+	}
+}
+
+// histogramQuantile
+// returns boundary of the bucket containing q-th observation,
+// upper boundary is used unless it is infinite
+func histogramQuantile(buckets []float64, counts []uint64, total uint64, q float64) float64 {
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, count := range counts {
+		seen += count
+		if seen < rank {
+			continue
+		}
+		if !math.IsInf(buckets[i+1], 1) {
+			return buckets[i+1]
+		}
+		return buckets[i]
+	}
+
+	return buckets[len(buckets)-1]
+}
+
+// runtimeMetricName
+// converts runtime/metrics name like /gc/heap/allocs:bytes to go_gc_heap_allocs_bytes
+func runtimeMetricName(name string) string {
+	return "go_" + strings.NewReplacer("/", "_", ":", "_", "-", "_").Replace(strings.TrimPrefix(name, "/"))
+}
+
+// compileGlob
+// converts glob pattern to regexp, '*' matches any sequence of characters including '/', '?' matches single character
+func compileGlob(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+
+	return regexp.MustCompile("^" + quoted + "$")
+}
@@ -0,0 +1,259 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/internal/prometheus"
+)
+
+const (
+	defaultScrapeTimeout = 5 * time.Second
+	relabelActionReplace = "replace"
+	relabelActionDrop    = "drop"
+)
+
+var ErrScrapeStatus = errors.New("unexpected scrape response status")
+
+type relabelRule struct {
+	regex       *regexp.Regexp
+	replacement string
+	drop        bool
+}
+
+type scraper struct {
+	target   config.ScrapeTarget
+	client   *http.Client
+	interval time.Duration
+	rules    []relabelRule
+	totals   map[string]uint64
+}
+
+// newScrapers
+// validates scrape targets from config and compiles their relabel rules
+func newScrapers(targets []config.ScrapeTarget, pollInterval int) ([]*scraper, error) {
+	scrapers := make([]*scraper, 0, len(targets))
+	for _, target := range targets {
+		if target.URL == "" {
+			return nil, fmt.Errorf("scrape target '%s' without url", target.Name)
+		}
+
+		timeout := defaultScrapeTimeout
+		if target.Timeout > 0 {
+			timeout = time.Duration(target.Timeout) * time.Second
+		}
+		interval := target.Interval
+		if interval <= 0 {
+			interval = pollInterval
+		}
+
+		s := &scraper{
+			target:   target,
+			client:   &http.Client{Timeout: timeout},
+			interval: time.Duration(interval) * time.Second,
+			totals:   make(map[string]uint64),
+		}
+
+		for _, rule := range target.Relabel {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("scrape target '%s' relabel regex: %w", target.Name, err)
+			}
+			switch rule.Action {
+			case "", relabelActionReplace, relabelActionDrop:
+			default:
+				return nil, fmt.Errorf("scrape target '%s' unknown relabel action '%s'", target.Name, rule.Action)
+			}
+			s.rules = append(s.rules, relabelRule{regex: re, replacement: rule.Replacement, drop: rule.Action == relabelActionDrop})
+		}
+
+		scrapers = append(scrapers, s)
+	}
+
+	return scrapers, nil
+}
+
+// RunScrapers
+// periodically scrapes every configured prometheus target until context is done
+func (agent *Agent) RunScrapers(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, s := range agent.scrapers {
+		wg.Add(1)
+		go func(s *scraper) {
+			defer wg.Done()
+			agent.runScraper(ctx, s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (agent *Agent) runScraper(ctx context.Context, s *scraper) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			start := time.Now()
+			metrics, err := s.scrape(ctx)
+			agent.stats.observeCollect("scrape_"+s.name(), time.Since(start))
+			if err != nil {
+				logger.Log.Error("scrape error", zap.String("target", s.target.URL), zap.Error(err))
+				continue
+			}
+
+			agent.mu.Lock()
+			agent.Metrics = append(agent.Metrics, metrics...)
+			agent.mu.Unlock()
+		}
+	}
+}
+
+// name
+// returns target name used in self metrics, url is used for unnamed targets
+func (s *scraper) name() string {
+	if s.target.Name != "" {
+		return s.target.Name
+	}
+
+	return metricSuffix(s.target.URL)[1:]
+}
+
+// scrape
+// fetches target and converts exposed samples into metrics
+func (s *scraper) scrape(ctx context.Context) ([]model.Metrics, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.target.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %d", ErrScrapeStatus, res.StatusCode)
+	}
+
+	samples, err := prometheus.Parse(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.convert(samples), nil
+}
+
+// convert
+// counters, histogram buckets and counts become counters with delta since previous scrape,
+// other samples become gauges. Non-finite values are skipped since they can't be encoded in json
+func (s *scraper) convert(samples []prometheus.Sample) []model.Metrics {
+	var metrics []model.Metrics
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+
+		id, ok := s.relabel(sample.ID())
+		if !ok {
+			continue
+		}
+		id = limitID(id)
+
+		if isPrometheusCounter(sample) {
+			if delta, ok := s.delta(id, sample.Value); ok {
+				metrics = append(metrics, model.Metrics{ID: id, MType: model.MetricTypeCounter, Delta: &delta})
+			}
+			continue
+		}
+
+		value := sample.Value
+		metrics = append(metrics, model.Metrics{ID: id, MType: model.MetricTypeGauge, Value: &value})
+	}
+
+	return metrics
+}
+
+// relabel
+// applies relabel rules in order, returns false if metric should be dropped
+func (s *scraper) relabel(id string) (string, bool) {
+	for _, rule := range s.rules {
+		if !rule.regex.MatchString(id) {
+			continue
+		}
+		if rule.drop {
+			return "", false
+		}
+		id = rule.regex.ReplaceAllString(id, rule.replacement)
+	}
+
+	return id, id != ""
+}
+
+// limitID
+// shortens id longer than model.MaxIDLength, since a single such id fails the whole batch on server.
+// The end of id is replaced by hash of the whole id, so different long ids stay different
+func limitID(id string) string {
+	if len(id) <= model.MaxIDLength {
+		return id
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	suffix := fmt.Sprintf("#%016x", h.Sum64())
+
+	cut := model.MaxIDLength - len(suffix)
+	for cut > 0 && !utf8.RuneStart(id[cut]) {
+		cut--
+	}
+
+	return id[:cut] + suffix
+}
+
+// delta
+// returns counter increase since previous scrape, first scrape and counter reset only remember the total
+func (s *scraper) delta(id string, value float64) (int64, bool) {
+	if value < 0 {
+		return 0, false
+	}
+
+	total := uint64(value)
+	prev, ok := s.totals[id]
+	s.totals[id] = total
+	if !ok || total < prev {
+		return 0, false
+	}
+
+	return int64(total - prev), true
+}
+
+func isPrometheusCounter(sample prometheus.Sample) bool {
+	switch sample.Type {
+	case prometheus.TypeCounter:
+		return true
+	case prometheus.TypeHistogram:
+		return !strings.HasSuffix(sample.Name, "_sum")
+	case prometheus.TypeSummary:
+		return strings.HasSuffix(sample.Name, "_count")
+	}
+
+	return false
+}
@@ -0,0 +1,193 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// selfStats holds agent's own health figures
+type selfStats struct {
+	batchesSent    atomic.Int64
+	batchesFailed  atomic.Int64
+	batchesRetried atomic.Int64
+	batchesDropped atomic.Int64
+	lastReport     atomic.Int64
+	queueDepth     atomic.Int64
+	spooledBytes   atomic.Int64
+
+	mu        sync.Mutex
+	durations map[string]float64
+	reported  map[string]int64
+}
+
+type selfCounter struct {
+	id    string
+	name  string
+	value *atomic.Int64
+}
+
+func (s *selfStats) counters() []selfCounter {
+	return []selfCounter{
+		{id: "AgentBatchesSent", name: "agent_batches_sent_total", value: &s.batchesSent},
+		{id: "AgentBatchesFailed", name: "agent_batches_failed_total", value: &s.batchesFailed},
+		{id: "AgentBatchesRetried", name: "agent_batches_retried_total", value: &s.batchesRetried},
+		{id: "AgentBatchesDropped", name: "agent_batches_dropped_total", value: &s.batchesDropped},
+	}
+}
+
+// observeCollect
+// remembers duration of collector run
+func (s *selfStats) observeCollect(collector string, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.durations == nil {
+		s.durations = make(map[string]float64)
+	}
+	s.durations[collector] = duration.Seconds()
+}
+
+// metrics
+// returns self metrics for sending to server, counters are reported as delta since previous call
+func (s *selfStats) metrics() []model.Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reported == nil {
+		s.reported = make(map[string]int64)
+	}
+
+	var metrics []model.Metrics
+	for _, c := range s.counters() {
+		total := c.value.Load()
+		delta := total - s.reported[c.id]
+		s.reported[c.id] = total
+		metrics = append(metrics, model.Metrics{ID: c.id, MType: model.MetricTypeCounter, Delta: &delta})
+	}
+
+	for _, collector := range sortedKeys(s.durations) {
+		value := s.durations[collector]
+		metrics = append(metrics, model.Metrics{ID: "AgentCollectDuration_" + collector, MType: model.MetricTypeGauge, Value: &value})
+	}
+
+	queueDepth := float64(s.queueDepth.Load())
+	metrics = append(metrics, model.Metrics{ID: "AgentQueueDepth", MType: model.MetricTypeGauge, Value: &queueDepth})
+
+	spooledBytes := float64(s.spooledBytes.Load())
+	metrics = append(metrics, model.Metrics{ID: "AgentSpooledBytes", MType: model.MetricTypeGauge, Value: &spooledBytes})
+
+	if last := s.lastReport.Load(); last > 0 {
+		value := float64(last)
+		metrics = append(metrics, model.Metrics{ID: "AgentLastReportTime", MType: model.MetricTypeGauge, Value: &value})
+	}
+
+	return metrics
+}
+
+// writePrometheus
+// writes self metrics in prometheus text exposition format
+func (s *selfStats) writePrometheus(w io.Writer) {
+	for _, c := range s.counters() {
+		fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", c.name, c.name, c.value.Load())
+	}
+
+	s.mu.Lock()
+	fmt.Fprintf(w, "# TYPE agent_collect_duration_seconds gauge\n")
+	for _, collector := range sortedKeys(s.durations) {
+		fmt.Fprintf(w, "agent_collect_duration_seconds{collector=%q} %g\n", collector, s.durations[collector])
+	}
+	s.mu.Unlock()
+
+	fmt.Fprintf(w, "# TYPE agent_queue_depth gauge\nagent_queue_depth %d\n", s.queueDepth.Load())
+	fmt.Fprintf(w, "# TYPE agent_spooled_bytes gauge\nagent_spooled_bytes %d\n", s.spooledBytes.Load())
+	fmt.Fprintf(w, "# TYPE agent_last_report_timestamp_seconds gauge\nagent_last_report_timestamp_seconds %d\n", s.lastReport.Load())
+}
+
+// collect
+// runs collector if it is enabled and records its duration
+func (agent *Agent) collect(name string, collector func()) {
+	if !agent.collectorEnabled(name) {
+		return
+	}
+
+	start := time.Now()
+	collector()
+	agent.stats.observeCollect(name, time.Since(start))
+}
+
+// Poll
+// runs all enabled collectors
+func (agent *Agent) Poll() {
+	if len(agent.Config.RuntimeMetrics) > 0 {
+		agent.collect("runtime", agent.CollectRuntimeMetrics)
+		agent.CollectPollMetrics()
+	} else {
+		agent.collect("memstats", agent.CollectMemStatsMetrics)
+	}
+	agent.collect("memory", agent.CollectMemoryMetrics)
+	agent.collect("cpu", agent.CollectCPUMetrics)
+	agent.collect("load", agent.CollectLoadMetrics)
+	agent.collect("disk", agent.CollectDiskMetrics)
+	agent.collect("net", agent.CollectNetMetrics)
+	agent.collect("process", agent.CollectProcessMetrics)
+}
+
+// SelfMetricsHandler
+// returns handler exposing agent's own metrics in prometheus text format
+func (agent *Agent) SelfMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		res.WriteHeader(http.StatusOK)
+		agent.stats.writePrometheus(res)
+	})
+}
+
+// ListenSelfMetrics
+// serves agent's own metrics on /metrics until context is done
+func (agent *Agent) ListenSelfMetrics(ctx context.Context) error {
+	listener, err := net.Listen("tcp", agent.Config.SelfMetricsAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", agent.SelfMetricsHandler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Log.Info("Self metrics endpoint started", zap.String("address", listener.Addr().String()))
+	err = srv.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
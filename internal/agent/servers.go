@@ -0,0 +1,237 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/pkg/client"
+)
+
+var (
+	ErrNoServerAvailable = errors.New("no server available")
+	ErrSpoolFull         = errors.New("spool is full")
+)
+
+// serverTarget is a server metrics are delivered to, it keeps its own health state and batch limits
+type serverTarget struct {
+	address string
+	client  *client.Client
+	healthy atomic.Bool
+
+	mu            sync.Mutex
+	limits        model.Limits
+	limitsFetched bool
+
+	// spool keeps metrics not delivered to unavailable server in fan-out mode, oldest first
+	spoolMu    sync.Mutex
+	spool      []model.Metrics
+	spoolBytes int
+}
+
+// newServerTargets
+// creates targets with clients configured by agent's hash key, public key and retry count
+func (agent *Agent) newServerTargets(addresses []string) []*serverTarget {
+	targets := make([]*serverTarget, 0, len(addresses))
+	for _, address := range addresses {
+		target := &serverTarget{address: address}
+		target.client = client.New(address,
+			client.WithHTTPClient(agent.Client),
+			client.WithHashKey(agent.Config.HashKey),
+			client.WithPublicKey(agent.PubKey),
+			client.WithRetries(agent.Config.ReportRetryCount),
+			client.WithRetryHook(func(attempt int, err error) {
+				agent.stats.batchesFailed.Add(1)
+				agent.stats.batchesRetried.Add(1)
+				logger.Log.Info(fmt.Sprintf("retry %d to report metrics to %s", attempt, address), zap.Error(err))
+			}),
+		)
+		target.healthy.Store(true)
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// deliver
+// sends metrics according to delivery mode: in fan-out mode batch is sent to every server independently,
+// in failover mode to the first healthy server, falling back to the next ones on failure
+func (agent *Agent) deliver(ctx context.Context, metrics []model.Metrics) error {
+	if agent.Config.DeliveryMode == config.DeliveryModeFanOut {
+		return agent.deliverFanOut(ctx, metrics)
+	}
+
+	return agent.deliverFailover(ctx, metrics)
+}
+
+// deliverFanOut
+// sends metrics to every server along with metrics spooled for it. Metrics not delivered to unavailable server
+// are spooled and sent before the next batch, so the server gets them once it recovers
+func (agent *Agent) deliverFanOut(ctx context.Context, metrics []model.Metrics) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(agent.servers))
+	for i, target := range agent.servers {
+		wg.Add(1)
+		go func(i int, target *serverTarget) {
+			defer wg.Done()
+
+			pending := append(target.takeSpool(), metrics...)
+			sent, err := agent.reportMetricsWithRetry(ctx, target, pending)
+			if err == nil || !errors.Is(err, ErrDoRequest) || agent.Config.SpoolMaxBytes <= 0 {
+				errs[i] = err
+				return
+			}
+
+			spooled, dropped := target.addSpool(pending[sent:], agent.Config.SpoolMaxBytes)
+			logger.Log.Warn("server unavailable, metrics spooled", zap.String("address", target.address),
+				zap.Int("spooled", spooled), zap.Int("dropped", dropped), zap.Error(err))
+			if dropped > 0 {
+				errs[i] = fmt.Errorf("%w: %d metrics dropped from spool of %s", ErrSpoolFull, dropped, target.address)
+			}
+		}(i, target)
+	}
+	wg.Wait()
+
+	var spooled int
+	for _, target := range agent.servers {
+		spooled += target.spoolSize()
+	}
+	agent.stats.spooledBytes.Store(int64(spooled))
+
+	return errors.Join(errs...)
+}
+
+// takeSpool
+// returns spooled metrics and empties spool
+func (t *serverTarget) takeSpool() []model.Metrics {
+	t.spoolMu.Lock()
+	defer t.spoolMu.Unlock()
+
+	metrics := t.spool
+	t.spool, t.spoolBytes = nil, 0
+
+	return metrics
+}
+
+// addSpool
+// puts undelivered metrics before metrics spooled meanwhile by other workers and drops the oldest ones
+// exceeding maxBytes. Returns number of spooled and dropped metrics
+func (t *serverTarget) addSpool(metrics []model.Metrics, maxBytes int) (int, int) {
+	t.spoolMu.Lock()
+	defer t.spoolMu.Unlock()
+
+	t.spool = append(append([]model.Metrics{}, metrics...), t.spool...)
+	t.spoolBytes = 0
+	for _, metric := range t.spool {
+		t.spoolBytes += metricSize(metric)
+	}
+
+	dropped := 0
+	for t.spoolBytes > maxBytes && dropped < len(t.spool) {
+		t.spoolBytes -= metricSize(t.spool[dropped])
+		dropped++
+	}
+	t.spool = t.spool[dropped:]
+
+	return len(t.spool), dropped
+}
+
+// spoolSize
+// returns size of spooled metrics in bytes
+func (t *serverTarget) spoolSize() int {
+	t.spoolMu.Lock()
+	defer t.spoolMu.Unlock()
+
+	return t.spoolBytes
+}
+
+// metricSize
+// returns size of metric encoded to json, it is the size spool limit is applied to
+func metricSize(metric model.Metrics) int {
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return 0
+	}
+
+	return len(data)
+}
+
+// orderedServers
+// returns healthy servers first keeping configured priority, unhealthy ones are the last resort
+func (agent *Agent) orderedServers() []*serverTarget {
+	ordered := make([]*serverTarget, 0, len(agent.servers))
+	for _, target := range agent.servers {
+		if target.healthy.Load() {
+			ordered = append(ordered, target)
+		}
+	}
+	for _, target := range agent.servers {
+		if !target.healthy.Load() {
+			ordered = append(ordered, target)
+		}
+	}
+
+	return ordered
+}
+
+// preferredServer
+// returns the first healthy server
+func (agent *Agent) preferredServer() *serverTarget {
+	ordered := agent.orderedServers()
+	if len(ordered) == 0 {
+		return nil
+	}
+
+	return ordered[0]
+}
+
+func (agent *Agent) deliverFailover(ctx context.Context, metrics []model.Metrics) error {
+	err := ErrNoServerAvailable
+	for _, target := range agent.orderedServers() {
+		var sent int
+		sent, err = agent.reportMetricsWithRetry(ctx, target, metrics)
+		if err == nil || !errors.Is(err, ErrDoRequest) {
+			return err
+		}
+		// metrics already delivered to failed server are not sent again
+		metrics = metrics[sent:]
+		target.healthy.Store(false)
+		logger.Log.Warn("server unavailable, failing over", zap.String("address", target.address))
+	}
+
+	return err
+}
+
+// RunHealthChecks
+// periodically checks servers with /ping endpoint, so failover mode returns to preferred server once it recovers
+func (agent *Agent) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	if agent.Config.DeliveryMode == config.DeliveryModeFanOut || len(agent.servers) < 2 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, target := range agent.servers {
+				healthy := target.client.Ping(ctx) == nil
+				if target.healthy.Swap(healthy) != healthy {
+					logger.Log.Info("server health changed", zap.String("address", target.address), zap.Bool("healthy", healthy))
+				}
+			}
+		}
+	}
+}
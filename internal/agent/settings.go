@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+var ErrInvalidSettings = errors.New("invalid agent settings")
+
+// collectorNames are names of collectors which can be enabled by remote settings
+var collectorNames = []string{"runtime", "memstats", "memory", "cpu", "load", "disk", "net", "process"}
+
+// settings holds configuration which can be changed at runtime
+type settings struct {
+	pollInterval   time.Duration
+	reportInterval time.Duration
+	collectors     map[string]bool
+	filter         *metricFilter
+}
+
+// Intervals
+// returns actual poll and report intervals
+func (agent *Agent) Intervals() (time.Duration, time.Duration) {
+	agent.settingsMu.RLock()
+	defer agent.settingsMu.RUnlock()
+
+	poll := time.Duration(agent.Config.PollInterval) * time.Second
+	report := time.Duration(agent.Config.ReportInterval) * time.Second
+	if agent.settings.pollInterval > 0 {
+		poll = agent.settings.pollInterval
+	}
+	if agent.settings.reportInterval > 0 {
+		report = agent.settings.reportInterval
+	}
+
+	return poll, report
+}
+
+// SettingsUpdates
+// returns channel notified when settings are changed
+func (agent *Agent) SettingsUpdates() <-chan struct{} {
+	return agent.settingsUpdates
+}
+
+// ApplySettings
+// validates settings and applies them
+func (agent *Agent) ApplySettings(s model.AgentSettings) error {
+	if s.PollInterval < 0 || s.ReportInterval < 0 {
+		return fmt.Errorf("%w: intervals must be positive", ErrInvalidSettings)
+	}
+
+	var collectors map[string]bool
+	if len(s.Collectors) > 0 {
+		collectors = make(map[string]bool)
+		for _, name := range s.Collectors {
+			if !slices.Contains(collectorNames, name) {
+				return fmt.Errorf("%w: unknown collector '%s'", ErrInvalidSettings, name)
+			}
+			collectors[name] = true
+		}
+	}
+
+	filter := agent.localFilter
+	if s.Filter != nil {
+		var err error
+		filter, err = newMetricFilter(*s.Filter)
+		if err != nil {
+			return fmt.Errorf("%w: filter: %w", ErrInvalidSettings, err)
+		}
+	}
+
+	newSettings := settings{
+		pollInterval:   time.Duration(s.PollInterval) * time.Second,
+		reportInterval: time.Duration(s.ReportInterval) * time.Second,
+		collectors:     collectors,
+		filter:         filter,
+	}
+
+	agent.settingsMu.Lock()
+	changed := newSettings.pollInterval != agent.settings.pollInterval || newSettings.reportInterval != agent.settings.reportInterval
+	agent.settings = newSettings
+	agent.settingsMu.Unlock()
+
+	if changed && agent.settingsUpdates != nil {
+		select {
+		case agent.settingsUpdates <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// metricFilter
+// returns filter applied to metrics before report
+func (agent *Agent) metricFilter() *metricFilter {
+	agent.settingsMu.RLock()
+	defer agent.settingsMu.RUnlock()
+
+	return agent.settings.filter
+}
+
+// collectorEnabled
+// checks if collector is enabled by remote settings
+func (agent *Agent) collectorEnabled(name string) bool {
+	agent.settingsMu.RLock()
+	defer agent.settingsMu.RUnlock()
+
+	return agent.settings.collectors == nil || agent.settings.collectors[name]
+}
+
+// RunRemoteSettings
+// periodically fetches agent settings from server and applies them until context is done
+func (agent *Agent) RunRemoteSettings(ctx context.Context) {
+	if agent.Config.RemoteSettingsInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(agent.Config.RemoteSettingsInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		agent.updateSettings(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (agent *Agent) updateSettings(ctx context.Context) {
+	target := agent.preferredServer()
+	if target == nil {
+		return
+	}
+
+	s, err := target.client.AgentSettings(ctx, agent.Config.ID, agent.Config.Group)
+	if err != nil {
+		logger.Log.Debug("fetch agent settings error", zap.String("address", target.address), zap.Error(err))
+		return
+	}
+
+	if err := agent.ApplySettings(s); err != nil {
+		logger.Log.Error("remote agent settings rejected", zap.Error(err))
+	}
+}
@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/net"
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/logger"
+)
+
+// CollectCPUMetrics
+// Collect utilization of every logical core as CPUutilization1..N gauges
+func (agent *Agent) CollectCPUMetrics() {
+	percents, err := cpu.Percent(0, true)
+	if err != nil {
+		logger.Log.Error("cpu percent error", zap.Error(err))
+		return
+	}
+
+	for i, percent := range percents {
+		value := percent
+		agent.SetGaugeMetric(fmt.Sprintf("CPUutilization%d", i+1), &value)
+	}
+}
+
+// CollectLoadMetrics
+// Collect 1, 5 and 15 minutes load averages
+func (agent *Agent) CollectLoadMetrics() {
+	avg, err := load.Avg()
+	if err != nil {
+		logger.Log.Error("load average error", zap.Error(err))
+		return
+	}
+
+	agent.SetGaugeMetric("LoadAverage1", &avg.Load1)
+	agent.SetGaugeMetric("LoadAverage5", &avg.Load5)
+	agent.SetGaugeMetric("LoadAverage15", &avg.Load15)
+}
+
+// CollectDiskMetrics
+// Collect usage of every mounted partition and I/O counters of every disk
+func (agent *Agent) CollectDiskMetrics() {
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		logger.Log.Error("disk partitions error", zap.Error(err))
+	}
+
+	for _, partition := range partitions {
+		usage, err := disk.Usage(partition.Mountpoint)
+		if err != nil {
+			logger.Log.Debug("disk usage error", zap.String("mountpoint", partition.Mountpoint), zap.Error(err))
+			continue
+		}
+
+		suffix := metricSuffix(partition.Mountpoint)
+		total := float64(usage.Total)
+		free := float64(usage.Free)
+		used := float64(usage.Used)
+		usedPercent := usage.UsedPercent
+
+		agent.SetGaugeMetric("DiskTotal"+suffix, &total)
+		agent.SetGaugeMetric("DiskFree"+suffix, &free)
+		agent.SetGaugeMetric("DiskUsed"+suffix, &used)
+		agent.SetGaugeMetric("DiskUsedPercent"+suffix, &usedPercent)
+	}
+
+	counters, err := disk.IOCounters()
+	if err != nil {
+		logger.Log.Error("disk io counters error", zap.Error(err))
+		return
+	}
+
+	for name, stat := range counters {
+		suffix := metricSuffix(name)
+		agent.setCounterFromTotal("DiskReadBytes"+suffix, stat.ReadBytes)
+		agent.setCounterFromTotal("DiskWriteBytes"+suffix, stat.WriteBytes)
+		agent.setCounterFromTotal("DiskReadCount"+suffix, stat.ReadCount)
+		agent.setCounterFromTotal("DiskWriteCount"+suffix, stat.WriteCount)
+	}
+}
+
+// CollectNetMetrics
+// Collect sent and received bytes and packets of every network interface
+func (agent *Agent) CollectNetMetrics() {
+	counters, err := net.IOCounters(true)
+	if err != nil {
+		logger.Log.Error("net io counters error", zap.Error(err))
+		return
+	}
+
+	for _, stat := range counters {
+		suffix := metricSuffix(stat.Name)
+		agent.setCounterFromTotal("NetBytesSent"+suffix, stat.BytesSent)
+		agent.setCounterFromTotal("NetBytesRecv"+suffix, stat.BytesRecv)
+		agent.setCounterFromTotal("NetPacketsSent"+suffix, stat.PacketsSent)
+		agent.setCounterFromTotal("NetPacketsRecv"+suffix, stat.PacketsRecv)
+	}
+}
+
+// setCounterFromTotal
+// converts monotonically growing system total into counter delta since previous poll.
+// First observation only remembers the total, decreased total (e.g. after reboot or device reset) is treated as a new baseline
+func (agent *Agent) setCounterFromTotal(metricName string, total uint64) {
+	agent.mu.Lock()
+	if agent.totals == nil {
+		agent.totals = make(map[string]uint64)
+	}
+	prev, ok := agent.totals[metricName]
+	agent.totals[metricName] = total
+	agent.mu.Unlock()
+
+	if !ok || total < prev {
+		return
+	}
+
+	delta := int64(total - prev)
+	agent.SetCounterMetric(metricName, &delta)
+}
+
+// metricSuffix
+// builds metric name suffix from mountpoint or device name, so it can be safely used in URL path
+func metricSuffix(name string) string {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return "_root"
+	}
+
+	return "_" + strings.NewReplacer("/", "_", " ", "_", ":", "_").Replace(name)
+}
@@ -3,6 +3,7 @@ package compressor
 import (
 	"bytes"
 	"compress/gzip"
+	"io"
 )
 
 // Compress
@@ -26,3 +27,15 @@ func Compress(data []byte) ([]byte, error) {
 
 	return b.Bytes(), nil
 }
+
+// Decompress
+// accept gzipped data and decompress it
+func Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
@@ -6,30 +6,111 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/caarlos0/env/v6"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+const (
+	DeliveryModeFailover = "failover"
+	DeliveryModeFanOut   = "fanout"
 )
 
 type AgentConfig struct {
-	Address          string `env:"ADDRESS" json:"address"`
-	ReportInterval   int    `env:"REPORT_INTERVAL" json:"report_interval"`
-	ReportRetryCount int    `env:"REPORT_RETRY_COUNT" json:"report_retry_count"`
-	PollInterval     int    `env:"POLL_INTERVAL" json:"poll_interval"`
-	HashKey          string `env:"KEY" json:"key"`
-	RateLimit        int    `env:"RATE_LIMIT" json:"rate_limit"`
-	CryptoKey        string `env:"CRYPTO_KEY" json:"crypto_key"`
+	Address                string             `env:"ADDRESS" json:"address"`
+	ReportInterval         int                `env:"REPORT_INTERVAL" json:"report_interval"`
+	ReportRetryCount       int                `env:"REPORT_RETRY_COUNT" json:"report_retry_count"`
+	PollInterval           int                `env:"POLL_INTERVAL" json:"poll_interval"`
+	HashKey                string             `env:"KEY" json:"key"`
+	RateLimit              int                `env:"RATE_LIMIT" json:"rate_limit"`
+	CryptoKey              string             `env:"CRYPTO_KEY" json:"crypto_key"`
+	Processes              []ProcessMatcher   `json:"processes"`
+	RuntimeMetrics         []string           `env:"RUNTIME_METRICS" json:"runtime_metrics"`
+	StatsDAddress          string             `env:"STATSD_ADDRESS" json:"statsd_address"`
+	StatsDSocket           string             `env:"STATSD_SOCKET" json:"statsd_socket"`
+	PushAddress            string             `env:"PUSH_ADDRESS" json:"push_address"`
+	PushSocket             string             `env:"PUSH_SOCKET" json:"push_socket"`
+	ScrapeTargets          []ScrapeTarget     `json:"scrape_targets"`
+	DeliveryMode           string             `env:"DELIVERY_MODE" json:"delivery_mode"`
+	SpoolMaxBytes          int                `env:"SPOOL_MAX_BYTES" json:"spool_max_bytes"`
+	MaxBatchSize           int                `env:"MAX_BATCH_SIZE" json:"max_batch_size"`
+	MaxBatchBytes          int                `env:"MAX_BATCH_BYTES" json:"max_batch_bytes"`
+	SelfMetricsAddress     string             `env:"SELF_METRICS_ADDRESS" json:"self_metrics_address"`
+	ID                     string             `env:"AGENT_ID" json:"id"`
+	Group                  string             `env:"AGENT_GROUP" json:"group"`
+	RemoteSettingsInterval int                `env:"REMOTE_SETTINGS_INTERVAL" json:"remote_settings_interval"`
+	Filter                 model.MetricFilter `json:"filter"`
+	GaugeAggregation       string             `env:"GAUGE_AGGREGATION" json:"gauge_aggregation"`
+	Aggregation            []AggregationRule  `json:"aggregation"`
+}
+
+// AggregationRule
+// sets aggregation mode of gauges matching Pattern: none, last, min, max, avg or all.
+// Pattern is a glob, or a regular expression if wrapped in slashes
+type AggregationRule struct {
+	Pattern string `json:"pattern"`
+	Mode    string `json:"mode"`
+}
+
+// ProcessMatcher
+// describes group of processes to watch, process matches if it satisfies any of the set criteria.
+// Matched processes are reported under Name
+type ProcessMatcher struct {
+	Name    string `json:"name"`
+	PIDFile string `json:"pid_file"`
+	Pattern string `json:"pattern"`
+	Cgroup  string `json:"cgroup"`
+}
+
+// ScrapeTarget
+// describes prometheus endpoint scraped by agent. Interval and Timeout are in seconds,
+// Interval defaults to poll interval
+type ScrapeTarget struct {
+	Name     string        `json:"name"`
+	URL      string        `json:"url"`
+	Interval int           `json:"interval"`
+	Timeout  int           `json:"timeout"`
+	Relabel  []RelabelRule `json:"relabel"`
+}
+
+// RelabelRule
+// rewrites metric ID matching Regex with Replacement, or drops the metric if Action is "drop"
+type RelabelRule struct {
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+	Action      string `json:"action"`
 }
 
 func ConfigureAgent() *AgentConfig {
 	config := &AgentConfig{}
 
-	flag.StringVar(&config.Address, "a", "localhost:8080", "server host")
+	flag.StringVar(&config.Address, "a", "localhost:8080", "server host, comma separated list for multiple servers")
 	flag.IntVar(&config.ReportInterval, "r", 10, "report interval, seconds")
 	flag.IntVar(&config.ReportRetryCount, "c", 3, "report retry count")
 	flag.IntVar(&config.PollInterval, "p", 2, "poll interval, seconds")
 	flag.StringVar(&config.HashKey, "k", "", "hash key")
 	flag.IntVar(&config.RateLimit, "l", 1, "rate limit")
 	flag.StringVar(&config.CryptoKey, "crypto-key", "", "crypto key")
+	flag.Func("runtime-metrics", "comma separated glob patterns of runtime/metrics names, e.g. /gc/*,/sched/*", func(s string) error {
+		config.RuntimeMetrics = strings.Split(s, ",")
+		return nil
+	})
+	flag.StringVar(&config.StatsDAddress, "statsd-address", "", "statsd UDP listen address, e.g. localhost:8125")
+	flag.StringVar(&config.StatsDSocket, "statsd-socket", "", "statsd unix datagram socket path")
+	flag.StringVar(&config.PushAddress, "push-address", "", "local push API loopback address, e.g. localhost:8079")
+	flag.StringVar(&config.PushSocket, "push-socket", "", "local push API unix socket path")
+	flag.StringVar(&config.DeliveryMode, "delivery-mode", DeliveryModeFailover, "delivery mode for multiple servers: failover or fanout")
+	flag.IntVar(&config.SpoolMaxBytes, "spool-max-bytes", 1<<20, "max size of metrics kept for every unavailable server in fanout mode, 0 - disabled")
+	flag.IntVar(&config.MaxBatchSize, "max-batch-size", 0, "max metrics count in one request, 0 - unlimited")
+	flag.IntVar(&config.MaxBatchBytes, "max-batch-bytes", 0, "max compressed size of one request in bytes, 0 - unlimited")
+	flag.StringVar(&config.SelfMetricsAddress, "self-metrics-address", "", "address of agent's own /metrics endpoint, e.g. localhost:9091")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&config.ID, "id", hostname, "agent identity used to request remote settings")
+	flag.StringVar(&config.Group, "group", "", "agent group used to request remote settings")
+	flag.IntVar(&config.RemoteSettingsInterval, "remote-settings-interval", 0, "interval of requesting settings from server, seconds, 0 - disabled")
+	flag.StringVar(&config.GaugeAggregation, "gauge-aggregation", "last", "aggregation of gauge samples over report interval: none, last, min, max, avg or all")
 	var configPath string
 	flag.StringVar(&configPath, "config", "", "config file")
 	flag.Parse()
@@ -49,15 +130,49 @@ func ConfigureAgent() *AgentConfig {
 		log.Fatal(fmt.Errorf("failed to parse config: %w", err))
 	}
 
+	if config.DeliveryMode != DeliveryModeFailover && config.DeliveryMode != DeliveryModeFanOut {
+		log.Fatal(fmt.Errorf("unknown delivery mode '%s'", config.DeliveryMode))
+	}
+
 	return config
 }
 
+// ServerAddresses
+// returns list of servers from comma separated Address
+func (cfg *AgentConfig) ServerAddresses() []string {
+	var addresses []string
+	for _, address := range strings.Split(cfg.Address, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
 func (cfg *AgentConfig) LogVars() {
 	log.Printf("* reportEndpoint=%s\n", cfg.Address)
 	log.Printf("* reportInterval=%d\n", cfg.ReportInterval)
 	log.Printf("* reportRetryCount=%d\n", cfg.ReportRetryCount)
 	log.Printf("* pollInterval=%d\n", cfg.PollInterval)
 	log.Printf("* rateLimit=%d\n", cfg.RateLimit)
+	log.Printf("* processes=%d\n", len(cfg.Processes))
+	log.Printf("* runtimeMetrics=%s\n", strings.Join(cfg.RuntimeMetrics, ","))
+	log.Printf("* statsdAddress=%s\n", cfg.StatsDAddress)
+	log.Printf("* statsdSocket=%s\n", cfg.StatsDSocket)
+	log.Printf("* pushAddress=%s\n", cfg.PushAddress)
+	log.Printf("* pushSocket=%s\n", cfg.PushSocket)
+	log.Printf("* scrapeTargets=%d\n", len(cfg.ScrapeTargets))
+	log.Printf("* deliveryMode=%s\n", cfg.DeliveryMode)
+	log.Printf("* spoolMaxBytes=%d\n", cfg.SpoolMaxBytes)
+	log.Printf("* maxBatchSize=%d\n", cfg.MaxBatchSize)
+	log.Printf("* maxBatchBytes=%d\n", cfg.MaxBatchBytes)
+	log.Printf("* selfMetricsAddress=%s\n", cfg.SelfMetricsAddress)
+	log.Printf("* id=%s\n", cfg.ID)
+	log.Printf("* group=%s\n", cfg.Group)
+	log.Printf("* remoteSettingsInterval=%d\n", cfg.RemoteSettingsInterval)
+	log.Printf("* gaugeAggregation=%s rules=%d\n", cfg.GaugeAggregation, len(cfg.Aggregation))
+	log.Printf("* filter: allow=%s deny=%s rename=%d prefix=%s\n", strings.Join(cfg.Filter.Allow, ","), strings.Join(cfg.Filter.Deny, ","), len(cfg.Filter.Rename), cfg.Filter.Prefix)
 }
 
 func (cfg *AgentConfig) loadAgentConfigFile(configPath string) error {
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// AgentSettingsFile
+// provides agent settings from json file, file is reloaded when modified
+type AgentSettingsFile struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	set     model.AgentSettingsSet
+}
+
+func NewAgentSettingsFile(path string) *AgentSettingsFile {
+	return &AgentSettingsFile{path: path}
+}
+
+// Get
+// returns actual settings set, previously loaded set is returned if file is not modified
+func (f *AgentSettingsFile) Get() (model.AgentSettingsSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return f.set, err
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return f.set, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return f.set, fmt.Errorf("failed to read file by path '%s': %w", f.path, err)
+	}
+
+	var set model.AgentSettingsSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return f.set, fmt.Errorf("failed to unmarshal agent settings '%s': %w", f.path, err)
+	}
+
+	f.set = set
+	f.modTime = info.ModTime()
+
+	return f.set, nil
+}
@@ -10,30 +10,85 @@ import (
 	"github.com/caarlos0/env/v6"
 )
 
+const (
+	StorageEngineMemory   = "memory"
+	StorageEnginePostgres = "postgres"
+	StorageEngineFile     = "file"
+)
+
 type ServerConfig struct {
-	Host          string `env:"ADDRESS" json:"address"`
-	StoragePath   string `env:"STORAGE_PATH" json:"store_file"`
-	StoreInterval int64  `env:"STORE_INTERVAL" json:"store_interval"`
-	Restore       bool   `env:"RESTORE" json:"restore"`
-	Loglevel      string `env:"LOG_LEVEL" json:"log_level"`
-	DatabaseDSN   string `env:"DATABASE_DSN" json:"database_dsn"`
-	Key           string `env:"KEY" json:"key"`
-	CryptoKey     string `env:"CRYPTO_KEY" json:"crypto_key"`
+	Host                string `env:"ADDRESS" json:"address"`
+	StoragePath         string `env:"STORAGE_PATH" json:"store_file"`
+	StoreInterval       int64  `env:"STORE_INTERVAL" json:"store_interval"`
+	Restore             bool   `env:"RESTORE" json:"restore"`
+	Loglevel            string `env:"LOG_LEVEL" json:"log_level"`
+	DatabaseDSN         string `env:"DATABASE_DSN" json:"database_dsn"`
+	Key                 string `env:"KEY" json:"key"`
+	CryptoKey           string `env:"CRYPTO_KEY" json:"crypto_key"`
+	MaxBatchSize        int    `env:"MAX_BATCH_SIZE" json:"max_batch_size"`
+	MaxBatchBytes       int    `env:"MAX_BATCH_BYTES" json:"max_batch_bytes"`
+	AgentSettings       string `env:"AGENT_SETTINGS" json:"agent_settings"`
+	WALPath             string `env:"WAL_PATH" json:"wal_path"`
+	WALSync             string `env:"WAL_SYNC" json:"wal_sync"`
+	WALSnapshotInterval int64  `env:"WAL_SNAPSHOT_INTERVAL" json:"wal_snapshot_interval"`
+	BackupKeep          int    `env:"BACKUP_KEEP" json:"backup_keep"`
+	BackupCompress      bool   `env:"BACKUP_COMPRESS" json:"backup_compress"`
+	AdminToken          string `env:"ADMIN_TOKEN" json:"admin_token"`
+	QueryTimeout        int64  `env:"QUERY_TIMEOUT" json:"query_timeout"`
+	DBMaxConns          int    `env:"DATABASE_MAX_CONNS" json:"database_max_conns"`
+	DBMinConns          int    `env:"DATABASE_MIN_CONNS" json:"database_min_conns"`
+	DBMaxConnLifetime   int64  `env:"DATABASE_MAX_CONN_LIFETIME" json:"database_max_conn_lifetime"`
+	HistoryPartition    string `env:"HISTORY_PARTITION" json:"history_partition"`
+	HistoryRetention    int64  `env:"HISTORY_RETENTION" json:"history_retention"`
+	RollupMinRetention  int64  `env:"ROLLUP_1M_RETENTION" json:"rollup_1m_retention"`
+	RollupHourRetention int64  `env:"ROLLUP_1H_RETENTION" json:"rollup_1h_retention"`
+	SeriesTTL           int64  `env:"SERIES_TTL" json:"series_ttl"`
+	StorageEngine       string `env:"STORAGE_ENGINE" json:"storage_engine"`
+	StorageDBPath       string `env:"STORAGE_DB_PATH" json:"storage_db_path"`
+	// BuildVersion is set by server binary and written to snapshots
+	BuildVersion string `json:"-"`
 }
 
 func ConfigureServer() *ServerConfig {
 	config := &ServerConfig{}
 
 	flag.StringVar(&config.Host, "a", "localhost:8080", "server host")
-	flag.StringVar(&config.StoragePath, "f", "/tmp/metrics-storage.json", "path to file to store metrics")
+	flag.StringVar(&config.StoragePath, "f", "/tmp/metrics-storage.json", "path to file to store metrics, backups are saved as <path>.<timestamp>, the file holds a copy of the newest one")
 	flag.Int64Var(&config.StoreInterval, "i", 300, "interval of storing metrics")
 	flag.BoolVar(&config.Restore, "r", true, "load metrics from file")
 	flag.StringVar(&config.DatabaseDSN, "d", "", "database DSN")
 	flag.StringVar(&config.Key, "k", "", "hash key")
 	flag.StringVar(&config.CryptoKey, "crypto-key", "", "crypto key")
 	flag.StringVar(&config.Loglevel, "l", "DEBUG", "log level")
+	flag.IntVar(&config.MaxBatchSize, "max-batch-size", 0, "max metrics count in batch update, 0 - unlimited")
+	flag.IntVar(&config.MaxBatchBytes, "max-batch-bytes", 0, "max compressed size of request body in bytes, 0 - unlimited")
+	flag.StringVar(&config.AgentSettings, "agent-settings", "", "path to json file with remote agent settings")
+	flag.StringVar(&config.WALPath, "wal", "", "path to write-ahead log of memory storage, empty - disabled")
+	flag.StringVar(&config.WALSync, "wal-sync", "interval", "write-ahead log fsync policy: always, interval or never")
+	flag.Int64Var(&config.WALSnapshotInterval, "wal-snapshot-interval", 300, "interval of saving snapshot and truncating write-ahead log, seconds")
+	flag.IntVar(&config.BackupKeep, "backup-keep", 5, "number of timestamped backup files to keep")
+	flag.BoolVar(&config.BackupCompress, "backup-compress", false, "gzip backup files")
+	flag.StringVar(&config.AdminToken, "admin-token", "", "bearer token of /admin endpoints, empty - endpoints disabled")
+	flag.Int64Var(&config.QueryTimeout, "query-timeout", 5000, "timeout of storage queries made by request, milliseconds, 0 - unlimited")
+	flag.IntVar(&config.DBMaxConns, "db-max-conns", 0, "max size of database connection pool, 0 - pgx default")
+	flag.IntVar(&config.DBMinConns, "db-min-conns", 0, "min size of database connection pool")
+	flag.Int64Var(&config.DBMaxConnLifetime, "db-max-conn-lifetime", 0, "max lifetime of database connection, seconds, 0 - pgx default")
+	flag.StringVar(&config.HistoryPartition, "history-partition", "day", "period of database history partition: day or week")
+	flag.Int64Var(&config.HistoryRetention, "history-retention", 1, "days to keep raw history samples, 0 - forever, at most 1 day unless engine is postgres")
+	flag.Int64Var(&config.RollupMinRetention, "rollup-1m-retention", 30, "days to keep 1 minute history rollups, 0 - forever")
+	flag.Int64Var(&config.RollupHourRetention, "rollup-1h-retention", 365, "days to keep 1 hour history rollups, 0 - forever")
+	flag.Int64Var(&config.SeriesTTL, "series-ttl", 0, "seconds after the last update when metric is deleted, 0 - never")
+	flag.StringVar(&config.StorageEngine, "storage-engine", "", "storage of metrics: memory, postgres or file, empty - postgres if database DSN is set, memory otherwise")
+	flag.StringVar(&config.StorageDBPath, "storage-db", "/tmp/metrics.db", "path to file of file storage engine")
 	var configPath string
 	flag.StringVar(&configPath, "config", "", "config file")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [export|import [file]]\n", os.Args[0])
+		fmt.Fprintln(out, "  export - write snapshot of all metrics to file or stdout and exit")
+		fmt.Fprintln(out, "  import - load snapshot from file or stdin into configured storage and exit")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if envConfig := os.Getenv("CONFIG"); envConfig != "" {
@@ -51,9 +106,32 @@ func ConfigureServer() *ServerConfig {
 		log.Fatal(fmt.Errorf("failed to parse config: %w", err))
 	}
 
+	switch config.Engine() {
+	case StorageEngineMemory, StorageEngineFile:
+	case StorageEnginePostgres:
+		if config.DatabaseDSN == "" {
+			log.Fatal(fmt.Errorf("storage engine '%s' requires database DSN", config.StorageEngine))
+		}
+	default:
+		log.Fatal(fmt.Errorf("unknown storage engine '%s'", config.StorageEngine))
+	}
+
 	return config
 }
 
+// Engine
+// returns storage engine, if it is not set postgres is used when database DSN is set and memory otherwise
+func (cfg *ServerConfig) Engine() string {
+	if cfg.StorageEngine != "" {
+		return cfg.StorageEngine
+	}
+	if cfg.DatabaseDSN != "" {
+		return StorageEnginePostgres
+	}
+
+	return StorageEngineMemory
+}
+
 func (cfg *ServerConfig) loadServerConfigFile(configPath string) error {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
@@ -73,4 +151,24 @@ func (cfg *ServerConfig) LogVars() {
 	log.Printf("* StorePath=%s\n", cfg.StoragePath)
 	log.Printf("* StoreInterval=%d\n", cfg.StoreInterval)
 	log.Printf("* Restore=%t\n", cfg.Restore)
+	log.Printf("* MaxBatchSize=%d\n", cfg.MaxBatchSize)
+	log.Printf("* MaxBatchBytes=%d\n", cfg.MaxBatchBytes)
+	log.Printf("* AgentSettings=%s\n", cfg.AgentSettings)
+	log.Printf("* WALPath=%s\n", cfg.WALPath)
+	log.Printf("* WALSync=%s\n", cfg.WALSync)
+	log.Printf("* WALSnapshotInterval=%d\n", cfg.WALSnapshotInterval)
+	log.Printf("* BackupKeep=%d\n", cfg.BackupKeep)
+	log.Printf("* BackupCompress=%t\n", cfg.BackupCompress)
+	log.Printf("* AdminEndpoints=%t\n", cfg.AdminToken != "")
+	log.Printf("* QueryTimeout=%d\n", cfg.QueryTimeout)
+	log.Printf("* DBMaxConns=%d\n", cfg.DBMaxConns)
+	log.Printf("* DBMinConns=%d\n", cfg.DBMinConns)
+	log.Printf("* DBMaxConnLifetime=%d\n", cfg.DBMaxConnLifetime)
+	log.Printf("* HistoryPartition=%s\n", cfg.HistoryPartition)
+	log.Printf("* HistoryRetention=%d\n", cfg.HistoryRetention)
+	log.Printf("* RollupMinRetention=%d\n", cfg.RollupMinRetention)
+	log.Printf("* RollupHourRetention=%d\n", cfg.RollupHourRetention)
+	log.Printf("* SeriesTTL=%d\n", cfg.SeriesTTL)
+	log.Printf("* StorageEngine=%s\n", cfg.Engine())
+	log.Printf("* StorageDBPath=%s\n", cfg.StorageDBPath)
 }
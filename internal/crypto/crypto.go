@@ -79,6 +79,20 @@ func Decrypt(data []byte, privateKey []byte) ([]byte, error) {
 	return data, nil
 }
 
+// EncryptedSize returns the largest size of message of given size encrypted for the private key
+func EncryptedSize(size int64, privateKey []byte) (int64, error) {
+	key, err := x509.ParsePKCS1PrivateKey(privateKey)
+	if err != nil {
+		return 0, err
+	}
+
+	blockSize := int64(key.PublicKey.Size())
+	step := blockSize - 11
+	chunks := (size + step - 1) / step
+
+	return chunks * blockSize, nil
+}
+
 // DecryptChunks decrypt the message in chunks if the message is larger than the key length
 func DecryptChunks(random io.Reader, priv *rsa.PrivateKey, msg []byte) ([]byte, error) {
 	msgLen := len(msg)
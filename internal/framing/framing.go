@@ -0,0 +1,45 @@
+// Package framing implements checksummed line records of append-only files.
+// Every record is a line with CRC32 checksum and JSON encoded value,
+// so a record torn by crash or damaged on disk is detected when it is read
+package framing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"hash/crc32"
+)
+
+// Encode
+// returns line of JSON encoded value prefixed with its checksum
+func Encode(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(checksum(data))
+	buf.WriteByte(' ')
+	buf.Write(data)
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), nil
+}
+
+// Decode
+// verifies checksum of line and decodes its value into v, false is returned for damaged line
+func Decode(line []byte, v any) bool {
+	sum, data, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !ok || string(sum) != checksum(data) {
+		return false
+	}
+
+	return json.Unmarshal(data, v) == nil
+}
+
+func checksum(data []byte) string {
+	sum := crc32.ChecksumIEEE(data)
+
+	return hex.EncodeToString([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+}
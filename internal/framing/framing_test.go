@@ -0,0 +1,40 @@
+package framing
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	type value struct {
+		ID    string `json:"id"`
+		Delta int64  `json:"delta"`
+	}
+
+	// format is kept on disk, it must not change
+	line, err := Encode(value{ID: "PollCount", Delta: 5})
+	require.NoError(t, err)
+	assert.Equal(t, "982bef97 {\"id\":\"PollCount\",\"delta\":5}\n", string(line))
+
+	var decoded value
+	require.True(t, Decode(line, &decoded))
+	assert.Equal(t, value{ID: "PollCount", Delta: 5}, decoded)
+
+	tests := []struct {
+		name string
+		line []byte
+	}{
+		{name: "torn line", line: line[:len(line)-5]},
+		{name: "damaged data", line: bytes.Replace(line, []byte("5"), []byte("6"), 1)},
+		{name: "no checksum", line: []byte(`{"id":"PollCount","delta":5}`)},
+		{name: "not json", line: []byte("00000000 \n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.False(t, Decode(tt.line, &decoded))
+		})
+	}
+}
@@ -30,7 +30,7 @@ func ExampleHandler_GetHandler() {
 		MType: model.MetricTypeGauge,
 		Value: &value,
 	}
-	service.SaveMetric(metric)
+	service.SaveMetric(context.Background(), metric)
 
 	mux := chi.NewRouter()
 	mux.Get("/value/{metricType}/{metricName}", h.GetHandler)
@@ -72,7 +72,7 @@ func ExampleHandler_GetJSONHandler() {
 		MType: model.MetricTypeGauge,
 		Value: &value,
 	}
-	service.SaveMetric(metric)
+	service.SaveMetric(context.Background(), metric)
 
 	mux := chi.NewRouter()
 	mux.Post("/value/", h.GetJSONHandler)
@@ -110,8 +110,8 @@ func ExampleHandler_GetAllHandler() {
 	h := NewHandler(service, cfg.Key)
 
 	// prepare storage data
-	service.Save(model.MetricTypeGauge, "Alloc", "1.250000")
-	service.Save(model.MetricTypeCounter, "Count", "10")
+	service.Save(context.Background(), model.MetricTypeGauge, "Alloc", "1.250000")
+	service.Save(context.Background(), model.MetricTypeCounter, "Count", "10")
 
 	mux := chi.NewRouter()
 	mux.Get("/", h.GetAllHandler)
@@ -2,24 +2,40 @@
 package handler
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/derpartizanen/metrics/internal/hash"
+	"github.com/derpartizanen/metrics/internal/history"
 	"github.com/derpartizanen/metrics/internal/model"
 	"github.com/derpartizanen/metrics/internal/repository/memstorage"
+	"github.com/derpartizanen/metrics/internal/snapshot"
 	"github.com/derpartizanen/metrics/internal/storage"
 )
 
 const HashHeader = "HashSHA256"
 
+// defaultHistoryRange is a range of history returned when 'from' query param is omitted
+const defaultHistoryRange = time.Hour
+
 type Handler struct {
-	storage *storage.Storage
-	hashKey string
+	storage       *storage.Storage
+	hashKey       string
+	limits        model.Limits
+	agentSettings AgentSettingsProvider
+}
+
+// AgentSettingsProvider
+// Interface for getting remote agent settings
+type AgentSettingsProvider interface {
+	Get() (model.AgentSettingsSet, error)
 }
 
 func NewHandler(storage *storage.Storage, hashKey string) *Handler {
@@ -29,6 +45,13 @@ func NewHandler(storage *storage.Storage, hashKey string) *Handler {
 	}
 }
 
+// WithLimits
+// sets batch update limits enforced by BatchUpdateJSONHandler and advertised by LimitsHandler
+func (h *Handler) WithLimits(limits model.Limits) *Handler {
+	h.limits = limits
+	return h
+}
+
 // UpdateHandler
 // Update metric by metricName, metricType and metricName in URL params
 func (h *Handler) UpdateHandler(res http.ResponseWriter, req *http.Request) {
@@ -36,9 +59,9 @@ func (h *Handler) UpdateHandler(res http.ResponseWriter, req *http.Request) {
 	metricName := req.PathValue("metricName")
 	metricValue := req.PathValue("metricValue")
 
-	err := h.storage.Save(metricType, metricName, metricValue)
+	err := h.storage.Save(req.Context(), metricType, metricName, metricValue)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 
@@ -53,7 +76,7 @@ func (h *Handler) GetHandler(res http.ResponseWriter, req *http.Request) {
 
 	var result string
 
-	value, err := h.storage.Get(metricType, metricName)
+	value, err := h.storage.Get(req.Context(), metricType, metricName)
 	if err != nil {
 		if errors.Is(err, storage.ErrInvalidMetricType) {
 			http.Error(res, err.Error(), http.StatusBadRequest)
@@ -63,7 +86,7 @@ func (h *Handler) GetHandler(res http.ResponseWriter, req *http.Request) {
 			http.Error(res, "metric not found", http.StatusNotFound)
 			return
 		}
-		http.Error(res, err.Error(), http.StatusInternalServerError)
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusInternalServerError))
 		return
 	}
 
@@ -83,7 +106,7 @@ func (h *Handler) GetHandler(res http.ResponseWriter, req *http.Request) {
 // Returns all metrics with their values in text/html format
 func (h *Handler) GetAllHandler(res http.ResponseWriter, req *http.Request) {
 	var result string
-	metrics, _ := h.storage.GetAllMetrics()
+	metrics, _ := h.storage.GetAllMetrics(req.Context())
 
 	for _, metric := range metrics {
 		if metric.MType == model.MetricTypeCounter {
@@ -113,13 +136,13 @@ func (h *Handler) GetJSONHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = h.storage.GetMetric(&metric)
+	err = h.storage.GetMetric(req.Context(), &metric)
 
 	if err != nil {
 		if errors.Is(err, storage.ErrInvalidMetricType) {
 			http.Error(res, err.Error(), http.StatusBadRequest)
 		} else {
-			http.Error(res, err.Error(), http.StatusNotFound)
+			http.Error(res, err.Error(), storageErrorStatus(err, http.StatusNotFound))
 		}
 		return
 	}
@@ -149,15 +172,15 @@ func (h *Handler) UpdateJSONHandler(res http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	err = h.storage.SaveMetric(metric)
+	err = h.storage.SaveMetric(req.Context(), metric)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 
-	err = h.storage.GetMetric(&metric)
+	err = h.storage.GetMetric(req.Context(), &metric)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusInternalServerError))
 		return
 	}
 
@@ -181,23 +204,240 @@ func (h *Handler) BatchUpdateJSONHandler(res http.ResponseWriter, req *http.Requ
 	var metrics []model.Metrics
 	err := decoder.Decode(&metrics)
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(res, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = h.storage.SetAllMetrics(metrics)
+	if h.limits.MaxBatchSize > 0 && len(metrics) > h.limits.MaxBatchSize {
+		http.Error(res, fmt.Sprintf("batch exceeds %d metrics", h.limits.MaxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	err = h.storage.SetAllMetrics(req.Context(), metrics)
+	if err != nil {
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+// WithAgentSettings
+// sets provider of settings served by AgentSettingsHandler
+func (h *Handler) WithAgentSettings(provider AgentSettingsProvider) *Handler {
+	h.agentSettings = provider
+	return h
+}
+
+// AgentSettingsHandler
+// Returns settings for agent identified by id and group query params in json format
+func (h *Handler) AgentSettingsHandler(res http.ResponseWriter, req *http.Request) {
+	if h.agentSettings == nil {
+		http.Error(res, "agent settings are not configured", http.StatusNotFound)
+		return
+	}
+
+	set, err := h.agentSettings.Get()
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	settings, ok := set.Lookup(req.URL.Query().Get("id"), req.URL.Query().Get("group"))
+	if !ok {
+		http.Error(res, "agent settings not found", http.StatusNotFound)
+		return
+	}
+
+	resp, err := json.Marshal(settings)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set(HashHeader, hash.Calc(h.hashKey, resp))
+	res.WriteHeader(http.StatusOK)
+	res.Write(resp)
+}
+
+// LimitsHandler
+// Returns batch update limits accepted by server in json format
+func (h *Handler) LimitsHandler(res http.ResponseWriter, req *http.Request) {
+	resp, err := json.Marshal(h.limits)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(resp)
+}
+
+// ResetCounterHandler
+// Sets counter by metricName in URL params to zero
+func (h *Handler) ResetCounterHandler(res http.ResponseWriter, req *http.Request) {
+	err := h.storage.ResetCounter(req.Context(), req.PathValue("metricName"))
+	if err != nil {
+		if errors.Is(err, memstorage.ErrNotFound) || errors.Is(err, sql.ErrNoRows) {
+			http.Error(res, "metric not found", http.StatusNotFound)
+			return
+		}
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+// DeleteHandler
+// Deletes metric by metricType and metricName in URL params
+func (h *Handler) DeleteHandler(res http.ResponseWriter, req *http.Request) {
+	err := h.storage.Delete(req.Context(), req.PathValue("metricType"), req.PathValue("metricName"))
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidMetricType) {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, memstorage.ErrNotFound) || errors.Is(err, sql.ErrNoRows) {
+			http.Error(res, "metric not found", http.StatusNotFound)
+			return
+		}
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+// DeleteByPatternHandler
+// Deletes metrics which names match shell pattern in 'pattern' query param, e.g. 'host1.*',
+// optional 'type' query param limits deletion to metrics of one type. Returns count of deleted metrics
+func (h *Handler) DeleteByPatternHandler(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	count, err := h.storage.DeleteByPattern(req.Context(), query.Get("pattern"), query.Get("type"))
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidPattern) || errors.Is(err, storage.ErrInvalidMetricType) {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	resp, _ := json.Marshal(map[string]int{"deleted": count})
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(resp)
+}
+
+// HistoryHandler
+// Returns history of metric by metricType and metricName in URL params in json format.
+// Optional query params: from and to in RFC3339 format (last hour by default) and resolution: raw, 1m or 1h
+// (chosen by range by default)
+func (h *Handler) HistoryHandler(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	to := time.Now()
+	if value := query.Get("to"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("invalid 'to' param: %s", err), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+
+	from := to.Add(-defaultHistoryRange)
+	if value := query.Get("from"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("invalid 'from' param: %s", err), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		http.Error(res, "'from' must be before 'to'", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.storage.GetHistory(req.Context(), req.PathValue("metricType"), req.PathValue("metricName"),
+		from, to, query.Get("resolution"))
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidMetricType) || errors.Is(err, history.ErrInvalidResolution) {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	resp, err := json.Marshal(result)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set(HashHeader, hash.Calc(h.hashKey, resp))
+	res.WriteHeader(http.StatusOK)
+	res.Write(resp)
+}
+
+// ExportHandler
+// Returns snapshot of all metrics in json format, it can be loaded by ImportHandler of any server
+func (h *Handler) ExportHandler(res http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	err := h.storage.Export(req.Context(), &buf)
+	if err != nil {
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Content-Disposition", `attachment; filename="metrics-snapshot.json"`)
+	res.WriteHeader(http.StatusOK)
+	res.Write(buf.Bytes())
+}
+
+// ImportHandler
+// Loads snapshot from request body, imported metric values replace current ones
+func (h *Handler) ImportHandler(res http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(req.Body)
 	if err != nil {
 		http.Error(res, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	count, err := h.storage.Import(req.Context(), data)
+	if err != nil {
+		if errors.Is(err, snapshot.ErrInvalidFormat) || errors.Is(err, snapshot.ErrCountMismatch) ||
+			errors.Is(err, storage.ErrBackupChecksum) || errors.Is(err, storage.ErrInvalidBackup) {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(res, err.Error(), storageErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	resp, _ := json.Marshal(map[string]int{"imported": count})
+	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(http.StatusOK)
+	res.Write(resp)
 }
 
 // PingHandler
 // Can be used to check if service connected to database
 func (h *Handler) PingHandler(res http.ResponseWriter, req *http.Request) {
-	err := h.storage.Ping()
+	err := h.storage.Ping(req.Context())
 	if err != nil {
 		res.WriteHeader(http.StatusInternalServerError)
 		return
@@ -206,3 +446,13 @@ func (h *Handler) PingHandler(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set("Content-Type", "text/html")
 	res.WriteHeader(http.StatusOK)
 }
+
+// storageErrorStatus
+// returns 503 status if storage call is interrupted by query timeout, otherwise fallback status
+func storageErrorStatus(err error, fallback int) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+
+	return fallback
+}
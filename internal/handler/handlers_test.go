@@ -3,6 +3,7 @@ package handler
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/derpartizanen/metrics/internal/config"
 	"github.com/derpartizanen/metrics/internal/model"
@@ -161,8 +163,8 @@ func TestHandler_GetHandler(t *testing.T) {
 	store := storage.New(context.Background(), cfg)
 	h := NewHandler(store, cfg.Key)
 
-	store.Save(model.MetricTypeGauge, "Alloc", "123")
-	store.Save(model.MetricTypeCounter, "PollCounter", "10")
+	store.Save(context.Background(), model.MetricTypeGauge, "Alloc", "123")
+	store.Save(context.Background(), model.MetricTypeCounter, "PollCounter", "10")
 
 	tests := []struct {
 		name           string
@@ -227,8 +229,8 @@ func TestHandler_GetJSONHandler(t *testing.T) {
 	store := storage.New(context.Background(), cfg)
 	h := NewHandler(store, cfg.Key)
 
-	store.Save(model.MetricTypeGauge, "Alloc", "123")
-	store.Save(model.MetricTypeCounter, "PollCounter", "10")
+	store.Save(context.Background(), model.MetricTypeGauge, "Alloc", "123")
+	store.Save(context.Background(), model.MetricTypeCounter, "PollCounter", "10")
 
 	tests := []struct {
 		name           string
@@ -276,3 +278,288 @@ func TestHandler_GetJSONHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_BatchUpdateJSONHandler_Limits(t *testing.T) {
+	var baseURL = "http://localhost:8080"
+	cfg := config.ServerConfig{}
+	store := storage.New(context.Background(), cfg)
+	h := NewHandler(store, cfg.Key).WithLimits(model.Limits{MaxBatchSize: 1, MaxBatchBytes: 100})
+
+	tests := []struct {
+		name         string
+		payload      string
+		expectedCode int
+	}{
+		{
+			name:         "within limits",
+			payload:      `[{"id":"Alloc","type":"gauge","value": 123}]`,
+			expectedCode: 200,
+		},
+		{
+			name:         "too many metrics",
+			payload:      `[{"id":"PollCounter","type":"counter","delta": 10}, {"id":"Alloc","type":"gauge","value": 123}]`,
+			expectedCode: 413,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", baseURL, "/updates/"), bytes.NewBuffer([]byte(tt.payload)))
+			res := httptest.NewRecorder()
+
+			h.BatchUpdateJSONHandler(res, req)
+			assert.Equal(t, tt.expectedCode, res.Code)
+		})
+	}
+}
+
+func TestHandler_LimitsHandler(t *testing.T) {
+	h := NewHandler(nil, "").WithLimits(model.Limits{MaxBatchSize: 100, MaxBatchBytes: 4096})
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost:8080/limits", nil)
+	res := httptest.NewRecorder()
+
+	h.LimitsHandler(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"max_batch_size": 100, "max_batch_bytes": 4096}`, res.Body.String())
+}
+
+type staticAgentSettings model.AgentSettingsSet
+
+func (s staticAgentSettings) Get() (model.AgentSettingsSet, error) {
+	return model.AgentSettingsSet(s), nil
+}
+
+func TestHandler_AgentSettingsHandler(t *testing.T) {
+	var baseURL = "http://localhost:8080"
+	h := NewHandler(nil, "").WithAgentSettings(staticAgentSettings{
+		Default: &model.AgentSettings{PollInterval: 2},
+		Groups:  map[string]model.AgentSettings{"db": {PollInterval: 5}},
+		Agents:  map[string]model.AgentSettings{"host1": {PollInterval: 1, Collectors: []string{"cpu"}}},
+	})
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedResult string
+	}{
+		{name: "by id", query: "?id=host1&group=db", expectedResult: `{"poll_interval": 1, "collectors": ["cpu"]}`},
+		{name: "by group", query: "?id=host2&group=db", expectedResult: `{"poll_interval": 5}`},
+		{name: "default", query: "?id=host2", expectedResult: `{"poll_interval": 2}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, baseURL+"/agent/settings"+tt.query, nil)
+			res := httptest.NewRecorder()
+
+			h.AgentSettingsHandler(res, req)
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.JSONEq(t, tt.expectedResult, res.Body.String())
+		})
+	}
+
+	t.Run("not configured", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, baseURL+"/agent/settings", nil)
+		res := httptest.NewRecorder()
+
+		NewHandler(nil, "").AgentSettingsHandler(res, req)
+		assert.Equal(t, http.StatusNotFound, res.Code)
+	})
+}
+
+func BenchmarkHandler_BatchUpdateJSONHandler_Parallel(b *testing.B) {
+	cfg := config.ServerConfig{}
+	store := storage.New(context.Background(), cfg)
+	h := NewHandler(store, cfg.Key)
+
+	var payload strings.Builder
+	payload.WriteString("[")
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			payload.WriteString(",")
+		}
+		fmt.Fprintf(&payload, `{"id":"Gauge%d","type":"gauge","value":%d},{"id":"Counter%d","type":"counter","delta":1}`, i, i, i)
+	}
+	payload.WriteString("]")
+	body := payload.String()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+			res := httptest.NewRecorder()
+			h.BatchUpdateJSONHandler(res, req)
+			if res.Code != http.StatusOK {
+				b.Errorf("unexpected status %d", res.Code)
+				return
+			}
+		}
+	})
+}
+
+func TestHandler_ExportImport(t *testing.T) {
+	source := storage.New(context.Background(), config.ServerConfig{})
+	require.NoError(t, source.Save(context.Background(), model.MetricTypeCounter, "PollCount", "5"))
+	require.NoError(t, source.Save(context.Background(), model.MetricTypeGauge, "Alloc", "1.5"))
+
+	res := httptest.NewRecorder()
+	NewHandler(source, "").ExportHandler(res, httptest.NewRequest(http.MethodGet, "/admin/export", nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	exported := res.Body.String()
+
+	target := storage.New(context.Background(), config.ServerConfig{})
+	require.NoError(t, target.Save(context.Background(), model.MetricTypeCounter, "PollCount", "100"))
+	h := NewHandler(target, "")
+
+	res = httptest.NewRecorder()
+	h.ImportHandler(res, httptest.NewRequest(http.MethodPost, "/admin/import", strings.NewReader(exported)))
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"imported": 2}`, res.Body.String())
+
+	value, err := target.Get(context.Background(), model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value)
+
+	res = httptest.NewRecorder()
+	h.ImportHandler(res, httptest.NewRequest(http.MethodPost, "/admin/import", strings.NewReader(`{"version":1,"count":3,"metrics":[]}`)))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestHandler_HistoryHandler(t *testing.T) {
+	cfg := config.ServerConfig{RollupMinRetention: 1}
+	store := storage.New(context.Background(), cfg)
+	h := NewHandler(store, cfg.Key)
+
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "5"))
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "3"))
+
+	tests := []struct {
+		name               string
+		metricType         string
+		query              string
+		expectedCode       int
+		expectedResolution string
+		expectedIncrease   int64
+	}{
+		{name: "default range", metricType: "counter", expectedCode: 200, expectedResolution: "1m", expectedIncrease: 8},
+		{name: "raw resolution", metricType: "counter", query: "?resolution=raw", expectedCode: 200, expectedResolution: "raw", expectedIncrease: 8},
+		{name: "bad resolution", metricType: "counter", query: "?resolution=5m", expectedCode: 400},
+		{name: "bad time", metricType: "counter", query: "?from=yesterday", expectedCode: 400},
+		{name: "empty range", metricType: "counter", query: "?from=2026-01-01T00:00:00Z&to=2026-01-01T00:00:00Z", expectedCode: 400},
+		{name: "bad metric type", metricType: "bad", expectedCode: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/history/"+tt.metricType+"/PollCount"+tt.query, nil)
+			req.SetPathValue("metricType", tt.metricType)
+			req.SetPathValue("metricName", "PollCount")
+			res := httptest.NewRecorder()
+
+			h.HistoryHandler(res, req)
+			require.Equal(t, tt.expectedCode, res.Code)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+
+			var result model.History
+			require.NoError(t, json.Unmarshal(res.Body.Bytes(), &result))
+			assert.Equal(t, tt.expectedResolution, result.Resolution)
+			var increase int64
+			for _, p := range result.Points {
+				increase += *p.Increase
+			}
+			assert.Equal(t, tt.expectedIncrease, increase)
+		})
+	}
+}
+
+func TestHandler_DeleteHandler(t *testing.T) {
+	cfg := config.ServerConfig{}
+	store := storage.New(context.Background(), cfg)
+	h := NewHandler(store, cfg.Key)
+
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeGauge, "Alloc", "1"))
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeGauge, "host1.cpu", "1"))
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "host1.requests", "1"))
+
+	tests := []struct {
+		name         string
+		metricType   string
+		metricName   string
+		expectedCode int
+	}{
+		{name: "existing metric", metricType: "gauge", metricName: "Alloc", expectedCode: 200},
+		{name: "deleted metric", metricType: "gauge", metricName: "Alloc", expectedCode: 404},
+		{name: "bad metric type", metricType: "bad", metricName: "Alloc", expectedCode: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/value/"+tt.metricType+"/"+tt.metricName, nil)
+			req.SetPathValue("metricType", tt.metricType)
+			req.SetPathValue("metricName", tt.metricName)
+			res := httptest.NewRecorder()
+
+			h.DeleteHandler(res, req)
+			assert.Equal(t, tt.expectedCode, res.Code)
+		})
+	}
+
+	t.Run("by pattern", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/metrics?pattern=host1.*", nil)
+		res := httptest.NewRecorder()
+
+		h.DeleteByPatternHandler(res, req)
+		require.Equal(t, http.StatusOK, res.Code)
+		assert.JSONEq(t, `{"deleted":2}`, res.Body.String())
+
+		req = httptest.NewRequest(http.MethodDelete, "/admin/metrics", nil)
+		res = httptest.NewRecorder()
+
+		h.DeleteByPatternHandler(res, req)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+}
+
+func TestHandler_ResetCounterHandler(t *testing.T) {
+	cfg := config.ServerConfig{}
+	store := storage.New(context.Background(), cfg)
+	h := NewHandler(store, cfg.Key)
+
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "5"))
+
+	for _, tt := range []struct {
+		name         string
+		metricName   string
+		expectedCode int
+	}{
+		{name: "existing counter", metricName: "PollCount", expectedCode: 200},
+		{name: "unknown counter", metricName: "Unknown", expectedCode: 404},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/reset/"+tt.metricName, nil)
+			req.SetPathValue("metricName", tt.metricName)
+			res := httptest.NewRecorder()
+
+			h.ResetCounterHandler(res, req)
+			assert.Equal(t, tt.expectedCode, res.Code)
+		})
+	}
+
+	value, err := store.Get(context.Background(), model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), value)
+
+	t.Run("reset flag in update", func(t *testing.T) {
+		payload := `{"id":"PollCount","type":"counter","delta":7,"reset":true}`
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(payload))
+			res := httptest.NewRecorder()
+
+			h.UpdateJSONHandler(res, req)
+			require.Equal(t, http.StatusOK, res.Code)
+		}
+
+		value, err := store.Get(context.Background(), model.MetricTypeCounter, "PollCount")
+		require.NoError(t, err)
+		assert.Equal(t, int64(7), value)
+	})
+}
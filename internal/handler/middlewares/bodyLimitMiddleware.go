@@ -0,0 +1,27 @@
+package middlewares
+
+import (
+	"net/http"
+)
+
+// Limit
+// restricts size of request body, handlers get *http.MaxBytesError when reading beyond the limit
+func (bm *BodyLimitMiddleware) Limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bm.MaxBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, bm.MaxBytes)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+type BodyLimitMiddleware struct {
+	MaxBytes int64
+}
+
+func NewBodyLimitMiddleware(maxBytes int64) *BodyLimitMiddleware {
+	return &BodyLimitMiddleware{
+		MaxBytes: maxBytes,
+	}
+}
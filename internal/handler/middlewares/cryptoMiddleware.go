@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net/http"
 
@@ -11,6 +12,8 @@ import (
 	"github.com/derpartizanen/metrics/internal/logger"
 )
 
+// Decrypt
+// decrypts request body, encrypted body over MaxBytes is rejected with 413
 func (cm *CryptoMiddleware) Decrypt() func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
@@ -19,9 +22,17 @@ func (cm *CryptoMiddleware) Decrypt() func(next http.Handler) http.Handler {
 				next.ServeHTTP(w, r)
 				return
 			}
+			if cm.MaxBytes > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, cm.MaxBytes)
+			}
 			body, err := io.ReadAll(r.Body)
 			if err != nil {
 				logger.Log.Error("Decrypt", zap.Error(err))
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
@@ -43,6 +54,8 @@ func (cm *CryptoMiddleware) Decrypt() func(next http.Handler) http.Handler {
 
 type CryptoMiddleware struct {
 	PrivateKey []byte
+	// MaxBytes limits size of encrypted body, zero means no limit
+	MaxBytes int64
 }
 
 func NewCryptoMiddleware(privateKeyPath string) *CryptoMiddleware {
@@ -59,3 +72,19 @@ func NewCryptoMiddleware(privateKeyPath string) *CryptoMiddleware {
 		PrivateKey: privateKey,
 	}
 }
+
+// WithBodyLimit
+// limits encrypted body to the size of maxBytes of plain body after encryption, zero means no limit
+func (cm *CryptoMiddleware) WithBodyLimit(maxBytes int64) *CryptoMiddleware {
+	if maxBytes <= 0 || len(cm.PrivateKey) == 0 {
+		return cm
+	}
+
+	limit, err := crypto.EncryptedSize(maxBytes, cm.PrivateKey)
+	if err != nil {
+		logger.Log.Fatal("encryptedSize", zap.Error(err))
+	}
+	cm.MaxBytes = limit
+
+	return cm
+}
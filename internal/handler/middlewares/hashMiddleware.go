@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net/http"
 
@@ -10,12 +11,18 @@ import (
 )
 
 // VerifyHash
-// check that hash in the header is equal with hash computing for body data
+// check that hash in the header is equal with hash computing for body data,
+// body over the limit of BodyLimitMiddleware is rejected with 413
 func (hm *HashMiddleware) VerifyHash(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get(handler.HashHeader) != "" {
 			payload, err := io.ReadAll(r.Body)
 			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					return
+				}
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
@@ -0,0 +1,119 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/crypto"
+	"github.com/derpartizanen/metrics/internal/handler"
+	"github.com/derpartizanen/metrics/internal/hash"
+	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/internal/storage"
+)
+
+func TestVerifyHash_BodyLimit(t *testing.T) {
+	const key = "secret"
+	cfg := config.ServerConfig{Key: key}
+	h := handler.NewHandler(storage.New(context.Background(), cfg), key).WithLimits(model.Limits{MaxBatchBytes: 100})
+
+	// the same order of middlewares as in server router
+	chain := NewBodyLimitMiddleware(100).Limit(GzipMiddleware(NewHashMiddleware(key).VerifyHash(http.HandlerFunc(h.BatchUpdateJSONHandler))))
+
+	tests := []struct {
+		name         string
+		payload      string
+		hash         string
+		expectedCode int
+	}{
+		{
+			name:         "within limits",
+			payload:      `[{"id":"Alloc","type":"gauge","value": 123}]`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "too large body",
+			payload:      `[{"id":"` + strings.Repeat("A", 100) + `","type":"gauge","value": 123}]`,
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "wrong hash",
+			payload:      `[{"id":"Alloc","type":"gauge","value": 123}]`,
+			hash:         "wrong",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/updates/", bytes.NewBufferString(tt.payload))
+			sum := tt.hash
+			if sum == "" {
+				sum = hash.Calc(key, []byte(tt.payload))
+			}
+			req.Header.Set(handler.HashHeader, sum)
+			res := httptest.NewRecorder()
+
+			chain.ServeHTTP(res, req)
+			assert.Equal(t, tt.expectedCode, res.Code)
+		})
+	}
+}
+
+func TestDecrypt_BodyLimit(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	cfg := config.ServerConfig{}
+	h := handler.NewHandler(storage.New(context.Background(), cfg), "").WithLimits(model.Limits{MaxBatchBytes: 100})
+	cm := (&CryptoMiddleware{PrivateKey: x509.MarshalPKCS1PrivateKey(key)}).WithBodyLimit(100)
+
+	// the same order of middlewares as in server router
+	chain := cm.Decrypt()(NewBodyLimitMiddleware(100).Limit(GzipMiddleware(NewHashMiddleware("").VerifyHash(http.HandlerFunc(h.BatchUpdateJSONHandler)))))
+
+	tests := []struct {
+		name         string
+		payload      string
+		expectedCode int
+	}{
+		{
+			name:         "within limits",
+			payload:      `[{"id":"Alloc","type":"gauge","value": 123}]`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "too large encrypted body",
+			payload:      `[{"id":"` + strings.Repeat("A", 1000) + `","type":"gauge","value": 123}]`,
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := crypto.Encrypt([]byte(tt.payload), publicKey)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/updates/", bytes.NewReader(body))
+			res := httptest.NewRecorder()
+
+			chain.ServeHTTP(res, req)
+			assert.Equal(t, tt.expectedCode, res.Code)
+		})
+	}
+
+	// body over the limit is rejected before it is read and decrypted as a whole
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:8080/updates/", bytes.NewReader(make([]byte, 1<<20)))
+	res := httptest.NewRecorder()
+	chain.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+}
@@ -0,0 +1,113 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+func TestChoose(t *testing.T) {
+	resolutions := Resolutions(24*time.Hour, 30*24*time.Hour, 0)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		from     time.Time
+		to       time.Time
+		expected string
+	}{
+		{name: "short range", from: now.Add(-10 * time.Minute), to: now, expected: ResolutionRaw},
+		{name: "too many raw points", from: now.Add(-6 * time.Hour), to: now, expected: ResolutionMinute},
+		{name: "raw samples expired", from: now.Add(-48 * time.Hour), to: now.Add(-47 * time.Hour), expected: ResolutionMinute},
+		{name: "long range", from: now.Add(-7 * 24 * time.Hour), to: now, expected: ResolutionHour},
+		{name: "beyond all retentions but forever", from: now.Add(-90 * 24 * time.Hour), to: now, expected: ResolutionHour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, Choose(resolutions, tt.from, tt.to, now).Name)
+		})
+	}
+
+	_, err := Lookup(resolutions, "5m")
+	assert.ErrorIs(t, err, ErrInvalidResolution)
+}
+
+func TestStore(t *testing.T) {
+	store := NewStore(Resolutions(time.Minute, time.Hour, 0))
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 90; i++ {
+		at := start.Add(time.Duration(i) * 2 * time.Second)
+		store.RecordGauge("Alloc", float64(i), at)
+		store.RecordCounter("PollCount", 2, int64(2*i+2), at)
+	}
+	end := start.Add(3 * time.Minute)
+
+	raw, err := store.Query(model.MetricTypeGauge, "Alloc", start, end, 0)
+	require.NoError(t, err)
+	// raw samples older than a minute are expired
+	assert.Len(t, raw, 30)
+	assert.Equal(t, float64(60), *raw[0].Min)
+
+	minutes, err := store.Query(model.MetricTypeGauge, "Alloc", start.Add(30*time.Second), end, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, minutes, 3)
+	assert.Equal(t, start, minutes[0].Time)
+	assert.Equal(t, int64(30), minutes[0].Count)
+	assert.Equal(t, float64(0), *minutes[0].Min)
+	assert.Equal(t, float64(29), *minutes[0].Max)
+	assert.Equal(t, float64(435), *minutes[0].Sum)
+	assert.Equal(t, 14.5, *minutes[0].Avg)
+	assert.Nil(t, minutes[0].Increase)
+
+	hours, err := store.Query(model.MetricTypeCounter, "PollCount", start, end, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, hours, 1)
+	assert.Equal(t, int64(180), *hours[0].Increase)
+	assert.Nil(t, hours[0].Avg)
+
+	// reset counter restarts from zero
+	store.RecordCounter("PollCount", 5, 5, end)
+	hours, err = store.Query(model.MetricTypeCounter, "PollCount", start, end.Add(time.Second), time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(185), *hours[0].Increase)
+
+	_, err = store.Query(model.MetricTypeGauge, "Alloc", start, end, 5*time.Minute)
+	assert.ErrorIs(t, err, ErrInvalidResolution)
+
+	unknown, err := store.Query(model.MetricTypeGauge, "Unknown", start, end, 0)
+	require.NoError(t, err)
+	assert.Empty(t, unknown)
+}
+
+func TestStore_Trim(t *testing.T) {
+	store := NewStore(Resolutions(time.Minute, time.Hour, time.Hour))
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	store.RecordGauge("Idle", 1, start)
+	store.RecordGauge("Alloc", 1, start)
+	store.RecordGauge("Alloc", 2, start.Add(90*time.Minute))
+
+	// idle series is not trimmed until sweep
+	raw, err := store.Query(model.MetricTypeGauge, "Idle", start, start.Add(time.Second), 0)
+	require.NoError(t, err)
+	assert.Len(t, raw, 1)
+
+	assert.Equal(t, 0, store.Trim(start.Add(30*time.Minute)))
+	raw, err = store.Query(model.MetricTypeGauge, "Idle", start, start.Add(time.Second), 0)
+	require.NoError(t, err)
+	assert.Empty(t, raw, "raw samples older than retention should be trimmed")
+	minutes, err := store.Query(model.MetricTypeGauge, "Idle", start, start.Add(time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, minutes, 1)
+
+	// series without points is removed, recently updated one is kept
+	assert.Equal(t, 1, store.Trim(start.Add(2*time.Hour)))
+	minutes, err = store.Query(model.MetricTypeGauge, "Alloc", start, start.Add(2*time.Hour), time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, minutes, 1)
+}
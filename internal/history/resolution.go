@@ -0,0 +1,110 @@
+// Package history keeps time series of metric values: raw samples and their rollups
+// into minute and hour resolutions, each resolution has its own retention
+package history
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ResolutionRaw    = "raw"
+	ResolutionMinute = "1m"
+	ResolutionHour   = "1h"
+)
+
+const (
+	// RawStep is an expected interval between raw samples, it estimates number of raw points in range
+	RawStep = 2 * time.Second
+	// MaxPoints is a number of points in range above which coarser resolution is chosen
+	MaxPoints = 1000
+)
+
+var (
+	ErrInvalidResolution = errors.New("invalid history resolution")
+)
+
+// Resolution of metric history
+type Resolution struct {
+	Name string
+	// Step is a length of aggregated interval, zero for raw samples
+	Step time.Duration
+	// Retention is a maximal age of kept points, zero means points are kept forever
+	Retention time.Duration
+}
+
+// Resolutions
+// returns raw, minute and hour resolutions with given retentions, from the finest to the coarsest
+func Resolutions(raw, minute, hour time.Duration) []Resolution {
+	return []Resolution{
+		{Name: ResolutionRaw, Retention: raw},
+		{Name: ResolutionMinute, Step: time.Minute, Retention: minute},
+		{Name: ResolutionHour, Step: time.Hour, Retention: hour},
+	}
+}
+
+// Lookup
+// returns resolution by name
+func Lookup(resolutions []Resolution, name string) (Resolution, error) {
+	for _, r := range resolutions {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+
+	return Resolution{}, fmt.Errorf("%w '%s'", ErrInvalidResolution, name)
+}
+
+// Choose
+// returns the finest resolution which keeps the whole range and has at most MaxPoints points in it,
+// the coarsest of resolutions keeping the range if all of them have more points.
+// If no resolution keeps the range, the one with the longest retention is returned
+func Choose(resolutions []Resolution, from, to, now time.Time) Resolution {
+	var kept, longest *Resolution
+	for i := range resolutions {
+		r := &resolutions[i]
+		if longest == nil || (longest.Retention != 0 && (r.Retention == 0 || r.Retention > longest.Retention)) {
+			longest = r
+		}
+		if !r.keeps(from, now) {
+			continue
+		}
+		if r.points(from, to) <= MaxPoints {
+			return *r
+		}
+		kept = r
+	}
+
+	if kept != nil {
+		return *kept
+	}
+	if longest != nil {
+		return *longest
+	}
+
+	return Resolution{}
+}
+
+// Start
+// returns start of interval of resolution containing t
+func (r Resolution) Start(t time.Time) time.Time {
+	if r.Step == 0 {
+		return t
+	}
+
+	return t.Truncate(r.Step)
+}
+
+func (r Resolution) keeps(from, now time.Time) bool {
+	return r.Retention == 0 || !from.Before(now.Add(-r.Retention))
+}
+
+func (r Resolution) points(from, to time.Time) int64 {
+	step := r.Step
+	if step == 0 {
+		step = RawStep
+	}
+
+	return int64(to.Sub(from) / step)
+}
@@ -0,0 +1,243 @@
+package history
+
+import (
+	"sync"
+	"time"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// Store keeps metric history in memory. Every sample updates the last point of each rollup,
+// so queries of any resolution do not scan raw samples. Store is safe for concurrent use
+type Store struct {
+	resolutions []Resolution
+
+	mu     sync.Mutex
+	series map[seriesKey]*series
+}
+
+type seriesKey struct {
+	mtype string
+	name  string
+}
+
+type series struct {
+	mu sync.Mutex
+	// points of every resolution ordered by time, raw samples are points with count 1
+	points [][]aggregate
+	// total is the last recorded counter value, it is valid once counted is set
+	total   int64
+	counted bool
+}
+
+type aggregate struct {
+	start    time.Time
+	count    int64
+	min      float64
+	max      float64
+	sum      float64
+	increase int64
+}
+
+// NewStore
+// creates empty history of given resolutions
+func NewStore(resolutions []Resolution) *Store {
+	return &Store{
+		resolutions: resolutions,
+		series:      make(map[seriesKey]*series),
+	}
+}
+
+// Resolutions
+// returns resolutions kept by store
+func (s *Store) Resolutions() []Resolution {
+	return s.resolutions
+}
+
+// RecordGauge
+// adds gauge value set at t
+func (s *Store) RecordGauge(name string, value float64, t time.Time) {
+	s.record(seriesKey{mtype: model.MetricTypeGauge, name: name}, value, nil, t)
+}
+
+// RecordCounter
+// adds counter value set at t by increment. Increase of counter is a difference of consecutive totals,
+// total less than the previous one means counter was reset and counted from zero again,
+// so increase is never negative. Increment is the increase of the first recorded sample
+func (s *Store) RecordCounter(name string, increment int64, total int64, t time.Time) {
+	s.record(seriesKey{mtype: model.MetricTypeCounter, name: name}, 0, func(ser *series) int64 {
+		increase := increment
+		if ser.counted {
+			increase = Increase(ser.total, total)
+		}
+		ser.total, ser.counted = total, true
+
+		return increase
+	}, t)
+}
+
+// Increase
+// returns increase of counter changed from prev to total, decreased counter is treated as reset
+func Increase(prev, total int64) int64 {
+	if total < prev {
+		return total
+	}
+
+	return total - prev
+}
+
+// Delete
+// removes history of metric
+func (s *Store) Delete(metricType string, name string) {
+	s.mu.Lock()
+	delete(s.series, seriesKey{mtype: metricType, name: name})
+	s.mu.Unlock()
+}
+
+// Query
+// returns points of resolution with given step which intersect [from, to), ordered by time
+func (s *Store) Query(metricType string, name string, from, to time.Time, step time.Duration) ([]model.HistoryPoint, error) {
+	idx := -1
+	for i, r := range s.resolutions {
+		if r.Step == step {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, ErrInvalidResolution
+	}
+
+	s.mu.Lock()
+	ser, ok := s.series[seriesKey{mtype: metricType, name: name}]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+
+	// the first intersecting point contains from
+	first := s.resolutions[idx].Start(from)
+
+	var points []model.HistoryPoint
+	for _, a := range ser.points[idx] {
+		if a.start.Before(first) {
+			continue
+		}
+		if !a.start.Before(to) {
+			break
+		}
+		points = append(points, a.point(metricType))
+	}
+
+	return points, nil
+}
+
+// record
+// adds sample to every resolution, increase of counter is computed under series lock
+func (s *Store) record(key seriesKey, value float64, increaseOf func(*series) int64, t time.Time) {
+	s.mu.Lock()
+	ser, ok := s.series[key]
+	if !ok {
+		ser = &series{points: make([][]aggregate, len(s.resolutions))}
+		s.series[key] = ser
+	}
+	s.mu.Unlock()
+
+	ser.mu.Lock()
+	defer ser.mu.Unlock()
+
+	var increase int64
+	if increaseOf != nil {
+		increase = increaseOf(ser)
+	}
+
+	for i, r := range s.resolutions {
+		points := ser.points[i]
+		start := r.Start(t)
+
+		// samples of the same interval and late samples are merged into the last point
+		last := len(points) - 1
+		if r.Step > 0 && last >= 0 && !start.After(points[last].start) {
+			points[last].add(value, increase)
+		} else {
+			a := aggregate{start: start}
+			a.add(value, increase)
+			points = append(points, a)
+		}
+
+		ser.points[i] = r.trim(points, t)
+	}
+}
+
+// Trim
+// removes points expired at now from every series, series left without points are removed.
+// Recording trims only the series it adds sample to, so Trim must be called periodically
+// to bound history of metrics which are not updated anymore. Returns number of removed series
+func (s *Store) Trim(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for key, ser := range s.series {
+		ser.mu.Lock()
+		empty := true
+		for i, r := range s.resolutions {
+			ser.points[i] = r.trim(ser.points[i], now)
+			empty = empty && len(ser.points[i]) == 0
+		}
+		ser.mu.Unlock()
+
+		if empty {
+			delete(s.series, key)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// trim
+// returns points which end after retention cutoff at now
+func (r Resolution) trim(points []aggregate, now time.Time) []aggregate {
+	if r.Retention <= 0 {
+		return points
+	}
+
+	cutoff := now.Add(-r.Retention)
+	expired := 0
+	for expired < len(points) && !points[expired].start.Add(r.Step).After(cutoff) {
+		expired++
+	}
+
+	return points[expired:]
+}
+
+func (a *aggregate) add(value float64, increase int64) {
+	if a.count == 0 || value < a.min {
+		a.min = value
+	}
+	if a.count == 0 || value > a.max {
+		a.max = value
+	}
+	a.count++
+	a.sum += value
+	a.increase += increase
+}
+
+func (a aggregate) point(metricType string) model.HistoryPoint {
+	p := model.HistoryPoint{Time: a.start, Count: a.count}
+	if metricType == model.MetricTypeCounter {
+		increase := a.increase
+		p.Increase = &increase
+		return p
+	}
+
+	minValue, maxValue, sum := a.min, a.max, a.sum
+	avg := sum / float64(a.count)
+	p.Min, p.Max, p.Sum, p.Avg = &minValue, &maxValue, &sum, &avg
+
+	return p
+}
@@ -1,15 +1,27 @@
 package interfaces
 
-import "github.com/derpartizanen/metrics/internal/model"
+import (
+	"context"
+	"time"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
 
 // Repository
-// Interface for working with storage
+// Interface for working with storage, context cancels or limits time of the operation
 type Repository interface {
-	UpdateCounterMetric(string, int64) error
-	UpdateGaugeMetric(string, float64) error
-	GetGaugeMetric(string) (float64, error)
-	GetCounterMetric(string) (int64, error)
-	GetAllMetrics() ([]model.Metrics, error)
-	SetAllMetrics(metrics []model.Metrics) error
-	Ping() error
+	UpdateCounterMetric(context.Context, string, int64) error
+	UpdateGaugeMetric(context.Context, string, float64) error
+	ResetCounterMetric(context.Context, string, int64) error
+	GetGaugeMetric(context.Context, string) (float64, error)
+	GetCounterMetric(context.Context, string) (int64, error)
+	GetAllMetrics(context.Context) ([]model.Metrics, error)
+	SetAllMetrics(ctx context.Context, metrics []model.Metrics) error
+	GetRecord(ctx context.Context, metricType string, name string) (model.MetricRecord, error)
+	GetAllRecords(context.Context) ([]model.MetricRecord, error)
+	RestoreRecords(ctx context.Context, records []model.MetricRecord) error
+	GetHistory(ctx context.Context, metricType string, name string, from, to time.Time, step time.Duration) ([]model.HistoryPoint, error)
+	DeleteMetric(ctx context.Context, metricType string, name string) error
+	DeleteStale(ctx context.Context, before time.Time) (int, error)
+	Ping(context.Context) error
 }
@@ -1,16 +1,57 @@
 package model
 
+import "time"
+
 const (
 	MetricTypeCounter = "counter"
 	MetricTypeGauge   = "gauge"
 )
 
-// Metrics schema for accepting request and response
+// MaxIDLength is a maximal length of metric id in bytes, longer ids do not fit database storage
+const MaxIDLength = 255
+
+// Metrics schema for accepting request and response.
+// Counter with Reset flag is set to Delta instead of being increased by it
 type Metrics struct {
 	ID    string   `json:"id"`
 	MType string   `json:"type"`
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
+	Reset bool     `json:"reset,omitempty"`
+}
+
+// MetricRecord is a stored metric with time of its last update
+type MetricRecord struct {
+	Metrics
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// HistoryPoint is an aggregate of metric samples recorded in [Time, Time + resolution step).
+// Gauge points have min, max, avg and sum of values, counter points have increase of counter
+// and its per-second rate in rollup resolutions
+type HistoryPoint struct {
+	Time     time.Time `json:"time"`
+	Count    int64     `json:"count"`
+	Min      *float64  `json:"min,omitempty"`
+	Max      *float64  `json:"max,omitempty"`
+	Avg      *float64  `json:"avg,omitempty"`
+	Sum      *float64  `json:"sum,omitempty"`
+	Increase *int64    `json:"increase,omitempty"`
+	Rate     *float64  `json:"rate,omitempty"`
+}
+
+// History of metric in resolution chosen for requested time range
+type History struct {
+	ID         string         `json:"id"`
+	MType      string         `json:"type"`
+	Resolution string         `json:"resolution"`
+	Points     []HistoryPoint `json:"points"`
+}
+
+// Limits of batch update request accepted by server, zero value means no limit
+type Limits struct {
+	MaxBatchSize  int `json:"max_batch_size"`
+	MaxBatchBytes int `json:"max_batch_bytes"`
 }
 
 var (
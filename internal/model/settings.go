@@ -0,0 +1,49 @@
+package model
+
+// AgentSettings is agent configuration served by server, zero values keep agent's local configuration
+type AgentSettings struct {
+	PollInterval   int `json:"poll_interval,omitempty"`
+	ReportInterval int `json:"report_interval,omitempty"`
+	// Collectors lists enabled collectors, all collectors are enabled if empty
+	Collectors []string `json:"collectors,omitempty"`
+	// Filter replaces agent's local filter if set
+	Filter *MetricFilter `json:"filter,omitempty"`
+}
+
+// AgentSettingsSet is a set of agent configurations by agent identity and group
+type AgentSettingsSet struct {
+	Default *AgentSettings           `json:"default,omitempty"`
+	Groups  map[string]AgentSettings `json:"groups,omitempty"`
+	Agents  map[string]AgentSettings `json:"agents,omitempty"`
+}
+
+// Lookup
+// returns settings of agent by its identity, then by its group, then default ones
+func (s AgentSettingsSet) Lookup(id string, group string) (AgentSettings, bool) {
+	if settings, ok := s.Agents[id]; ok && id != "" {
+		return settings, true
+	}
+	if settings, ok := s.Groups[group]; ok && group != "" {
+		return settings, true
+	}
+	if s.Default != nil {
+		return *s.Default, true
+	}
+
+	return AgentSettings{}, false
+}
+
+// MetricFilter describes metrics dropped and renamed by agent before sending.
+// Patterns are globs, or regular expressions if wrapped in slashes, e.g. /^go_.*/
+type MetricFilter struct {
+	Allow  []string     `json:"allow,omitempty" env:"ALLOW_METRICS"`
+	Deny   []string     `json:"deny,omitempty" env:"DENY_METRICS"`
+	Rename []RenameRule `json:"rename,omitempty"`
+	Prefix string       `json:"prefix,omitempty" env:"METRIC_PREFIX"`
+}
+
+// RenameRule replaces metric ID matching regular expression Regex with Replacement
+type RenameRule struct {
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+}
@@ -0,0 +1,67 @@
+package prometheus
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const exposition = `# HELP http_requests_total Total requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="get",path="/a \"quoted\" \\ path"} 3
+# TYPE temperature gauge
+temperature 21.5
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 5
+latency_seconds_bucket{le="+Inf"} 7
+latency_seconds_sum 1.25
+latency_seconds_count 7
+# TYPE rpc_duration summary
+rpc_duration{quantile="0.5"} 0.01
+rpc_duration_count 10
+untyped_metric NaN
+`
+
+func TestParse(t *testing.T) {
+	samples, err := Parse(strings.NewReader(exposition))
+	require.NoError(t, err)
+	require.Len(t, samples, 10)
+
+	assert.Equal(t, Sample{Name: "http_requests_total", Labels: map[string]string{"method": "post", "code": "200"}, Value: 1027, Type: TypeCounter}, samples[0])
+	assert.Equal(t, `/a "quoted" \ path`, samples[1].Labels["path"])
+	assert.Equal(t, Sample{Name: "temperature", Value: 21.5, Type: TypeGauge}, samples[2])
+	assert.Equal(t, TypeHistogram, samples[3].Type)
+	assert.Equal(t, TypeHistogram, samples[5].Type)
+	assert.Equal(t, TypeSummary, samples[7].Type)
+	assert.Equal(t, TypeSummary, samples[8].Type)
+	assert.Equal(t, TypeUntyped, samples[9].Type)
+	assert.True(t, math.IsNaN(samples[9].Value))
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{name: "no value", line: "metric"},
+		{name: "bad value", line: "metric abc"},
+		{name: "unclosed labels", line: `metric{a="b" 1`},
+		{name: "unquoted label", line: `metric{a=b} 1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.line))
+			assert.ErrorIs(t, err, ErrInvalidLine)
+		})
+	}
+}
+
+func TestSample_ID(t *testing.T) {
+	sample := Sample{Name: "http_requests_total", Labels: map[string]string{"method": "post", "code": "200"}}
+	assert.Equal(t, "http_requests_total;code=200;method=post", sample.ID())
+}
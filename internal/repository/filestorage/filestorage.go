@@ -0,0 +1,441 @@
+// Package filestorage keeps metrics in a single append-only file.
+//
+// Every change is appended to the file as a checksummed record with the resulting value of metric
+// and the file is synced before the change becomes visible, so acknowledged writes survive a crash.
+// Values are served from memory. When the file holds many more records than live metrics,
+// it is compacted by atomically replacing it with a file of the latest records only.
+package filestorage
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/history"
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/internal/repository/memstorage"
+)
+
+// FileStorage is safe for concurrent use. Writes are serialized by a single lock,
+// reads do not wait for writes
+type FileStorage struct {
+	path string
+	mem  *memstorage.MemStorage
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// records is a number of records in file, compaction starts when it exceeds compactAt
+	records   int
+	compactAt int
+}
+
+type metricKey struct {
+	mtype string
+	name  string
+}
+
+// New
+// opens storage file by path or creates it, metrics are restored from the file
+func New(path string) (*FileStorage, error) {
+	file, live, count, err := openLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s := &FileStorage{
+		path:    path,
+		mem:     memstorage.New(),
+		file:    file,
+		size:    info.Size(),
+		records: count,
+	}
+
+	records := make([]model.MetricRecord, 0, len(live))
+	for _, record := range live {
+		records = append(records, record)
+	}
+	if err := s.mem.RestoreRecords(context.Background(), records); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.compactIfNeeded(); err != nil {
+		s.file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// WithHistory
+// sets store recording every update, history is kept in memory only
+func (s *FileStorage) WithHistory(store *history.Store) *FileStorage {
+	s.mem.WithHistory(store)
+	return s
+}
+
+// UpdateGaugeMetric
+// set gauge metric value by name
+func (s *FileStorage) UpdateGaugeMetric(ctx context.Context, name string, value float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.compactAfterWrite()
+
+	err := s.write(setRecord(model.Metrics{ID: name, MType: model.MetricTypeGauge, Value: &value}, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	return s.mem.UpdateGaugeMetric(ctx, name, value)
+}
+
+// UpdateCounterMetric
+// set counter metric value by name
+func (s *FileStorage) UpdateCounterMetric(ctx context.Context, name string, value int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.compactAfterWrite()
+
+	total := s.counter(ctx, name) + value
+	err := s.write(setRecord(model.Metrics{ID: name, MType: model.MetricTypeCounter, Delta: &total}, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	return s.mem.UpdateCounterMetric(ctx, name, value)
+}
+
+// ResetCounterMetric
+// set counter metric value by name replacing accumulated one
+func (s *FileStorage) ResetCounterMetric(ctx context.Context, name string, value int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.compactAfterWrite()
+
+	err := s.write(setRecord(model.Metrics{ID: name, MType: model.MetricTypeCounter, Delta: &value}, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	return s.mem.ResetCounterMetric(ctx, name, value)
+}
+
+// GetGaugeMetric
+// get gauge metric by name
+func (s *FileStorage) GetGaugeMetric(ctx context.Context, metricName string) (float64, error) {
+	return s.mem.GetGaugeMetric(ctx, metricName)
+}
+
+// GetCounterMetric
+// get counter metric by name
+func (s *FileStorage) GetCounterMetric(ctx context.Context, metricName string) (int64, error) {
+	return s.mem.GetCounterMetric(ctx, metricName)
+}
+
+// GetAllMetrics
+// get all metrics from storage sorted by name, gauges go first
+func (s *FileStorage) GetAllMetrics(ctx context.Context) ([]model.Metrics, error) {
+	return s.mem.GetAllMetrics(ctx)
+}
+
+// GetRecord
+// get metric by type and name with time of its last update
+func (s *FileStorage) GetRecord(ctx context.Context, metricType string, name string) (model.MetricRecord, error) {
+	return s.mem.GetRecord(ctx, metricType, name)
+}
+
+// GetAllRecords
+// get all metrics with time of their last update, in the same order as GetAllMetrics
+func (s *FileStorage) GetAllRecords(ctx context.Context) ([]model.MetricRecord, error) {
+	return s.mem.GetAllRecords(ctx)
+}
+
+// SetAllMetrics
+// sets slice of metrics to storage, counters with reset flag are replaced.
+// Records of the whole slice are synced to file at once
+func (s *FileStorage) SetAllMetrics(ctx context.Context, metrics []model.Metrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.compactAfterWrite()
+
+	now := time.Now()
+	totals := make(map[string]int64)
+	var records []record
+	for _, metric := range metrics {
+		switch {
+		case metric.MType == model.MetricTypeCounter && metric.Delta != nil:
+			total, ok := totals[metric.ID]
+			if !ok {
+				total = s.counter(ctx, metric.ID)
+			}
+			if metric.Reset {
+				total = 0
+			}
+			total += *metric.Delta
+			totals[metric.ID] = total
+			records = append(records, setRecord(model.Metrics{ID: metric.ID, MType: metric.MType, Delta: &total}, now))
+		case metric.MType == model.MetricTypeGauge && metric.Value != nil:
+			value := *metric.Value
+			records = append(records, setRecord(model.Metrics{ID: metric.ID, MType: metric.MType, Value: &value}, now))
+		}
+	}
+
+	if err := s.write(records...); err != nil {
+		return err
+	}
+
+	return s.mem.SetAllMetrics(ctx, metrics)
+}
+
+// RestoreRecords
+// sets values of metrics and time of their last update, counters are replaced rather than increased.
+// Records of unknown types are skipped, zero update time is replaced by current time
+func (s *FileStorage) RestoreRecords(ctx context.Context, records []model.MetricRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.compactAfterWrite()
+
+	now := time.Now()
+	var restored []record
+	for _, r := range records {
+		updated := r.UpdatedAt
+		if updated.IsZero() {
+			updated = now
+		}
+
+		switch {
+		case r.MType == model.MetricTypeCounter && r.Delta != nil:
+			delta := *r.Delta
+			restored = append(restored, setRecord(model.Metrics{ID: r.ID, MType: r.MType, Delta: &delta}, updated))
+		case r.MType == model.MetricTypeGauge && r.Value != nil:
+			value := *r.Value
+			restored = append(restored, setRecord(model.Metrics{ID: r.ID, MType: r.MType, Value: &value}, updated))
+		}
+	}
+
+	if err := s.write(restored...); err != nil {
+		return err
+	}
+
+	return s.mem.RestoreRecords(ctx, records)
+}
+
+// GetHistory
+// get points of metric history in resolution with given step
+func (s *FileStorage) GetHistory(ctx context.Context, metricType string, name string, from, to time.Time, step time.Duration) ([]model.HistoryPoint, error) {
+	return s.mem.GetHistory(ctx, metricType, name, from, to, step)
+}
+
+// DeleteMetric
+// removes metric and its history by type and name
+func (s *FileStorage) DeleteMetric(ctx context.Context, metricType string, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.compactAfterWrite()
+
+	if !s.exists(ctx, metricType, name) {
+		return memstorage.ErrNotFound
+	}
+
+	err := s.write(record{Op: opDelete, MetricRecord: model.MetricRecord{Metrics: model.Metrics{ID: name, MType: metricType}}})
+	if err != nil {
+		return err
+	}
+
+	return s.mem.DeleteMetric(ctx, metricType, name)
+}
+
+// DeleteStale
+// removes metrics not updated since before and returns their count
+func (s *FileStorage) DeleteStale(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.compactAfterWrite()
+
+	all, err := s.mem.GetAllRecords(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var stale []record
+	for _, r := range all {
+		if r.UpdatedAt.Before(before) {
+			stale = append(stale, record{Op: opDelete, MetricRecord: model.MetricRecord{Metrics: model.Metrics{ID: r.ID, MType: r.MType}}})
+		}
+	}
+
+	if err := s.write(stale...); err != nil {
+		return 0, err
+	}
+
+	for _, r := range stale {
+		if err := s.mem.DeleteMetric(ctx, r.MType, r.ID); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(stale), nil
+}
+
+// Ping
+// verify if storage is in normal condition
+func (s *FileStorage) Ping(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return ErrClosed
+	}
+
+	_, err := s.file.Stat()
+
+	return err
+}
+
+// Close
+// syncs and closes storage file, it is safe to call Close more than once
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+// write
+// appends records to file and syncs it, partially written records are cut off on failure.
+// Must be called with s.mu held
+func (s *FileStorage) write(records ...record) error {
+	if s.file == nil {
+		return ErrClosed
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	var data []byte
+	for _, r := range records {
+		line, err := encode(r)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+	}
+
+	if _, err := s.file.Write(data); err != nil {
+		s.rollback()
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		s.rollback()
+		return err
+	}
+
+	s.size += int64(len(data))
+	s.records += len(records)
+
+	return nil
+}
+
+// rollback
+// cuts file to its last synced size, so failed write is not replayed on restart
+func (s *FileStorage) rollback() {
+	if err := s.file.Truncate(s.size); err == nil {
+		_, _ = s.file.Seek(s.size, io.SeekStart)
+	}
+}
+
+// compactAfterWrite
+// compacts file once written records are applied to memory. Records are already durable,
+// so failed compaction is logged and retried with the next write. Must be called with s.mu held
+func (s *FileStorage) compactAfterWrite() {
+	if err := s.compactIfNeeded(); err != nil {
+		logger.Log.Error("Storage file compaction failed", zap.String("path", s.path), zap.Error(err))
+	}
+}
+
+// compactIfNeeded
+// rewrites file with live metrics only, if most of its records are outdated.
+// Must be called with s.mu held
+func (s *FileStorage) compactIfNeeded() error {
+	if s.file == nil || s.records <= max(s.compactAt, compactMinRecords) {
+		return nil
+	}
+
+	records, err := s.mem.GetAllRecords(context.Background())
+	if err != nil {
+		return err
+	}
+
+	s.compactAt = compactRatio * len(records)
+	if s.records <= s.compactAt {
+		return nil
+	}
+
+	file, err := compact(s.path, records)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.size = info.Size()
+	s.records = len(records)
+
+	return nil
+}
+
+// counter
+// returns current value of counter, zero for unknown counter
+func (s *FileStorage) counter(ctx context.Context, name string) int64 {
+	value, err := s.mem.GetCounterMetric(ctx, name)
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+func (s *FileStorage) exists(ctx context.Context, metricType string, name string) bool {
+	var err error
+	switch metricType {
+	case model.MetricTypeGauge:
+		_, err = s.mem.GetGaugeMetric(ctx, name)
+	case model.MetricTypeCounter:
+		_, err = s.mem.GetCounterMetric(ctx, name)
+	default:
+		return false
+	}
+
+	return err == nil
+}
+
+func setRecord(metric model.Metrics, updated time.Time) record {
+	return record{Op: opSet, MetricRecord: model.MetricRecord{Metrics: metric, UpdatedAt: updated}}
+}
@@ -0,0 +1,144 @@
+package filestorage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/interfaces"
+	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/internal/repository/memstorage"
+	"github.com/derpartizanen/metrics/internal/repository/repotest"
+)
+
+func newStorage(t *testing.T, path string) *FileStorage {
+	s, err := New(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestFileStorage_Repository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) interfaces.Repository {
+		return newStorage(t, filepath.Join(t.TempDir(), "metrics.db"))
+	}, memstorage.ErrNotFound)
+
+	// the same suite passes against storage restored from file
+	repotest.Run(t, func(t *testing.T) interfaces.Repository {
+		return &reopened{t: t, FileStorage: newStorage(t, filepath.Join(t.TempDir(), "metrics.db"))}
+	}, memstorage.ErrNotFound)
+}
+
+// reopened reopens storage file before every read
+type reopened struct {
+	t *testing.T
+	*FileStorage
+}
+
+func (r *reopened) reopen() {
+	require.NoError(r.t, r.FileStorage.Close())
+	r.FileStorage = newStorage(r.t, r.path)
+}
+
+func (r *reopened) GetGaugeMetric(ctx context.Context, name string) (float64, error) {
+	r.reopen()
+	return r.FileStorage.GetGaugeMetric(ctx, name)
+}
+
+func (r *reopened) GetCounterMetric(ctx context.Context, name string) (int64, error) {
+	r.reopen()
+	return r.FileStorage.GetCounterMetric(ctx, name)
+}
+
+func (r *reopened) GetAllMetrics(ctx context.Context) ([]model.Metrics, error) {
+	r.reopen()
+	return r.FileStorage.GetAllMetrics(ctx)
+}
+
+func (r *reopened) GetAllRecords(ctx context.Context) ([]model.MetricRecord, error) {
+	r.reopen()
+	return r.FileStorage.GetAllRecords(ctx)
+}
+
+func TestFileStorage_TornRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+
+	s := newStorage(t, path)
+	require.NoError(t, s.UpdateCounterMetric(ctx, "PollCount", 5))
+	require.NoError(t, s.UpdateCounterMetric(ctx, "PollCount", 2))
+	require.NoError(t, s.Close())
+
+	// crash in the middle of the last record
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-5))
+
+	s = newStorage(t, path)
+	count, err := s.GetCounterMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), count)
+
+	// new records are not appended after the damaged one
+	require.NoError(t, s.UpdateCounterMetric(ctx, "PollCount", 1))
+	require.NoError(t, s.Close())
+
+	s = newStorage(t, path)
+	count, err = s.GetCounterMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), count)
+}
+
+func TestFileStorage_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"metrics":[]}`+"\n"), 0o644))
+
+	_, err := New(path)
+	assert.ErrorIs(t, err, ErrInvalidFile)
+}
+
+func TestFileStorage_Compaction(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+
+	s := newStorage(t, path)
+	require.NoError(t, s.UpdateGaugeMetric(ctx, "Alloc", 1.5))
+	require.NoError(t, s.UpdateGaugeMetric(ctx, "Deleted", 1))
+	require.NoError(t, s.DeleteMetric(ctx, model.MetricTypeGauge, "Deleted"))
+	for i := 0; i < 3*compactMinRecords; i++ {
+		require.NoError(t, s.UpdateCounterMetric(ctx, "PollCount", 1))
+	}
+
+	// file keeps only a few records above live ones
+	assert.Less(t, s.records, compactMinRecords+1)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, s.size, info.Size())
+	require.NoError(t, s.Close())
+
+	s = newStorage(t, path)
+	records, err := s.GetAllRecords(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "Alloc", records[0].ID)
+	assert.Equal(t, int64(3*compactMinRecords), *records[1].Delta)
+
+	// no temporary files are left
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestFileStorage_Closed(t *testing.T) {
+	s := newStorage(t, filepath.Join(t.TempDir(), "metrics.db"))
+	require.NoError(t, s.Close())
+	require.NoError(t, s.Close())
+
+	assert.ErrorIs(t, s.UpdateGaugeMetric(context.Background(), "Alloc", 1), ErrClosed)
+	assert.ErrorIs(t, s.Ping(context.Background()), ErrClosed)
+}
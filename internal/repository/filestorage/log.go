@@ -0,0 +1,193 @@
+package filestorage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/framing"
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// fileHeader is the first line of storage file
+const fileHeader = "metrics-db 1\n"
+
+const (
+	opSet    = "set"
+	opDelete = "del"
+)
+
+const (
+	// compactMinRecords is a number of records below which file is never compacted
+	compactMinRecords = 1024
+	// compactRatio is a ratio of records in file to live metrics above which file is compacted
+	compactRatio = 4
+)
+
+var (
+	ErrInvalidFile = errors.New("invalid storage file")
+	ErrClosed      = errors.New("storage is closed")
+)
+
+// record is a line of storage file, set records keep the whole state of metric,
+// so the latest record of metric is enough to restore it
+type record struct {
+	Op string `json:"op"`
+	model.MetricRecord
+}
+
+// openLog
+// opens or creates storage file and returns latest records of live metrics.
+// Reading stops at the first damaged record and the file is cut there,
+// so a record torn by crash is dropped and new records are not appended after garbage
+func openLog(path string) (*os.File, map[metricKey]model.MetricRecord, int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	live, count, err := readLog(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, 0, err
+	}
+
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, nil, 0, err
+	}
+
+	return file, live, count, nil
+}
+
+func readLog(file *os.File) (map[metricKey]model.MetricRecord, int, error) {
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadString('\n')
+	if errors.Is(err, io.EOF) && strings.HasPrefix(fileHeader, header) {
+		// new file or file torn while it was created
+		if err := file.Truncate(0); err != nil {
+			return nil, 0, err
+		}
+		if _, err := file.WriteAt([]byte(fileHeader), 0); err != nil {
+			return nil, 0, err
+		}
+		return map[metricKey]model.MetricRecord{}, 0, file.Sync()
+	}
+	if err != nil || header != fileHeader {
+		return nil, 0, fmt.Errorf("%w: unknown header", ErrInvalidFile)
+	}
+
+	live := make(map[metricKey]model.MetricRecord)
+	count := 0
+	offset := int64(len(header))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				logger.Log.Warn("Drop incomplete record of storage file", zap.Int64("offset", offset))
+				return live, count, truncate(file, offset)
+			}
+			return live, count, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		rec, ok := decode(line)
+		if !ok {
+			logger.Log.Warn("Drop damaged records of storage file", zap.Int64("offset", offset))
+			return live, count, truncate(file, offset)
+		}
+
+		key := metricKey{mtype: rec.MType, name: rec.ID}
+		switch rec.Op {
+		case opSet:
+			live[key] = rec.MetricRecord
+		case opDelete:
+			delete(live, key)
+		}
+		count++
+		offset += int64(len(line))
+	}
+}
+
+// compact
+// atomically replaces storage file with a file containing only given records
+func compact(path string, records []model.MetricRecord) (*os.File, error) {
+	var buf bytes.Buffer
+	buf.WriteString(fileHeader)
+	for _, r := range records {
+		line, err := encode(record{Op: opSet, MetricRecord: r})
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	if err := syncDir(dir); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
+}
+
+func truncate(file *os.File, offset int64) error {
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// syncDir makes rename durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func encode(rec record) ([]byte, error) {
+	return framing.Encode(rec)
+}
+
+func decode(line []byte) (record, bool) {
+	var rec record
+	if !framing.Decode(line, &rec) {
+		return record{}, false
+	}
+
+	return rec, true
+}
@@ -1,51 +1,134 @@
 package memstorage
 
 import (
+	"context"
 	"errors"
+	"hash/maphash"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/derpartizanen/metrics/internal/history"
 	"github.com/derpartizanen/metrics/internal/model"
 )
 
+// shardCount is a number of independently locked parts of storage, must be a power of two
+const shardCount = 64
+
 var (
 	ErrNotFound = errors.New("value not found")
 )
 
+// MemStorage is safe for concurrent use. Metrics are distributed among shards by name,
+// so writers of different metrics rarely wait for the same lock
 type MemStorage struct {
-	gauge   map[string]float64
-	counter map[string]int64
+	seed    maphash.Seed
+	shards  [shardCount]shard
+	history *history.Store
+}
+
+type shard struct {
+	mu      sync.RWMutex
+	gauge   map[string]gaugeEntry
+	counter map[string]counterEntry
+	// padding keeps neighbouring shard locks in different cache lines
+	_ [64]byte
+}
+
+type gaugeEntry struct {
+	value   float64
+	updated time.Time
+}
+
+type counterEntry struct {
+	value   int64
+	updated time.Time
 }
 
 // New
 // creates new memory storage with gauge and counter maps
 func New() *MemStorage {
-	return &MemStorage{
-		gauge:   make(map[string]float64),
-		counter: make(map[string]int64),
+	s := &MemStorage{seed: maphash.MakeSeed()}
+	for i := range s.shards {
+		s.shards[i].gauge = make(map[string]gaugeEntry)
+		s.shards[i].counter = make(map[string]counterEntry)
 	}
+
+	return s
+}
+
+// WithHistory
+// sets store recording every update, without it history of metrics is empty
+func (s *MemStorage) WithHistory(store *history.Store) *MemStorage {
+	s.history = store
+	return s
+}
+
+func (s *MemStorage) shard(name string) *shard {
+	return &s.shards[maphash.String(s.seed, name)&(shardCount-1)]
 }
 
 // UpdateGaugeMetric
 // set gauge metric value by name
-func (s *MemStorage) UpdateGaugeMetric(name string, value float64) error {
-	s.gauge[name] = value
+func (s *MemStorage) UpdateGaugeMetric(_ context.Context, name string, value float64) error {
+	now := time.Now()
+	sh := s.shard(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.gauge[name] = gaugeEntry{value: value, updated: now}
+	if s.history != nil {
+		s.history.RecordGauge(name, value, now)
+	}
 
 	return nil
 }
 
 // UpdateCounterMetric
 // set counter metric value by name
-func (s *MemStorage) UpdateCounterMetric(name string, value int64) error {
-	s.counter[name] += value
+func (s *MemStorage) UpdateCounterMetric(_ context.Context, name string, value int64) error {
+	now := time.Now()
+	sh := s.shard(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	total := sh.counter[name].value + value
+	sh.counter[name] = counterEntry{value: total, updated: now}
+	// history is recorded under the lock, so it sees totals in the same order as they are stored,
+	// otherwise a smaller total coming late would look like a counter reset
+	if s.history != nil {
+		s.history.RecordCounter(name, value, total, now)
+	}
+
+	return nil
+}
+
+// ResetCounterMetric
+// set counter metric value by name replacing accumulated one
+func (s *MemStorage) ResetCounterMetric(_ context.Context, name string, value int64) error {
+	now := time.Now()
+	sh := s.shard(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.counter[name] = counterEntry{value: value, updated: now}
+	if s.history != nil {
+		s.history.RecordCounter(name, value, value, now)
+	}
 
 	return nil
 }
 
 // GetGaugeMetric
 // get gauge metric by name
-func (s *MemStorage) GetGaugeMetric(metricName string) (float64, error) {
-	value, ok := s.gauge[metricName]
+func (s *MemStorage) GetGaugeMetric(_ context.Context, metricName string) (float64, error) {
+	sh := s.shard(metricName)
+	sh.mu.RLock()
+	entry, ok := sh.gauge[metricName]
+	sh.mu.RUnlock()
 	if ok {
-		return value, nil
+		return entry.value, nil
 	}
 
 	return 0, ErrNotFound
@@ -53,41 +136,110 @@ func (s *MemStorage) GetGaugeMetric(metricName string) (float64, error) {
 
 // GetCounterMetric
 // get counter metric by name
-func (s *MemStorage) GetCounterMetric(metricName string) (int64, error) {
-	value, ok := s.counter[metricName]
+func (s *MemStorage) GetCounterMetric(_ context.Context, metricName string) (int64, error) {
+	sh := s.shard(metricName)
+	sh.mu.RLock()
+	entry, ok := sh.counter[metricName]
+	sh.mu.RUnlock()
 	if ok {
-		return value, nil
+		return entry.value, nil
 	}
 
 	return 0, ErrNotFound
 }
 
 // GetAllMetrics
-// get all metrics from storage
-func (s *MemStorage) GetAllMetrics() ([]model.Metrics, error) {
-	var metrics []model.Metrics
-	for name, value := range s.gauge {
-		metrics = append(metrics, model.Metrics{ID: name, MType: "gauge", Value: &value})
+// get all metrics from storage sorted by name, gauges go first, every metric has its own copy of value.
+// Shards are read one by one, so result is not an atomic snapshot of the whole storage
+func (s *MemStorage) GetAllMetrics(ctx context.Context) ([]model.Metrics, error) {
+	records, err := s.GetAllRecords(ctx)
+	if err != nil {
+		return nil, err
 	}
-	for name, value := range s.counter {
-		metrics = append(metrics, model.Metrics{ID: name, MType: "counter", Delta: &value})
+
+	var metrics []model.Metrics
+	for _, record := range records {
+		metrics = append(metrics, record.Metrics)
 	}
 
 	return metrics, nil
 }
 
+// GetRecord
+// get metric by type and name with time of its last update
+func (s *MemStorage) GetRecord(_ context.Context, metricType string, name string) (model.MetricRecord, error) {
+	sh := s.shard(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	switch metricType {
+	case model.MetricTypeGauge:
+		if entry, ok := sh.gauge[name]; ok {
+			v := entry.value
+			return model.MetricRecord{Metrics: model.Metrics{ID: name, MType: metricType, Value: &v}, UpdatedAt: entry.updated}, nil
+		}
+	case model.MetricTypeCounter:
+		if entry, ok := sh.counter[name]; ok {
+			v := entry.value
+			return model.MetricRecord{Metrics: model.Metrics{ID: name, MType: metricType, Delta: &v}, UpdatedAt: entry.updated}, nil
+		}
+	}
+
+	return model.MetricRecord{}, ErrNotFound
+}
+
+// GetAllRecords
+// get all metrics with time of their last update, in the same order as GetAllMetrics
+func (s *MemStorage) GetAllRecords(_ context.Context) ([]model.MetricRecord, error) {
+	var gauges, counters []model.MetricRecord
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for name, entry := range sh.gauge {
+			v := entry.value
+			gauges = append(gauges, model.MetricRecord{
+				Metrics:   model.Metrics{ID: name, MType: model.MetricTypeGauge, Value: &v},
+				UpdatedAt: entry.updated,
+			})
+		}
+		for name, entry := range sh.counter {
+			v := entry.value
+			counters = append(counters, model.MetricRecord{
+				Metrics:   model.Metrics{ID: name, MType: model.MetricTypeCounter, Delta: &v},
+				UpdatedAt: entry.updated,
+			})
+		}
+		sh.mu.RUnlock()
+	}
+
+	byID := func(a, b model.MetricRecord) int {
+		return strings.Compare(a.ID, b.ID)
+	}
+	slices.SortFunc(gauges, byID)
+	slices.SortFunc(counters, byID)
+
+	return append(gauges, counters...), nil
+}
+
 // SetAllMetrics
-// sets slice of metrics to storage
-func (s *MemStorage) SetAllMetrics(metrics []model.Metrics) error {
+// sets slice of metrics to storage, counters with reset flag are replaced
+func (s *MemStorage) SetAllMetrics(ctx context.Context, metrics []model.Metrics) error {
 	for _, metric := range metrics {
-		if metric.MType == model.MetricTypeCounter {
-			err := s.UpdateCounterMetric(metric.ID, *metric.Delta)
+		if metric.MType == model.MetricTypeCounter && metric.Delta != nil && metric.Reset {
+			err := s.ResetCounterMetric(ctx, metric.ID, *metric.Delta)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if metric.MType == model.MetricTypeCounter && metric.Delta != nil {
+			err := s.UpdateCounterMetric(ctx, metric.ID, *metric.Delta)
 			if err != nil {
 				return err
 			}
 		}
-		if metric.MType == model.MetricTypeGauge {
-			err := s.UpdateGaugeMetric(metric.ID, *metric.Value)
+		if metric.MType == model.MetricTypeGauge && metric.Value != nil {
+			err := s.UpdateGaugeMetric(ctx, metric.ID, *metric.Value)
 			if err != nil {
 				return err
 			}
@@ -97,8 +249,100 @@ func (s *MemStorage) SetAllMetrics(metrics []model.Metrics) error {
 	return nil
 }
 
+// RestoreRecords
+// sets values of metrics and time of their last update, counters are replaced rather than increased.
+// Records of unknown types are skipped, zero update time is replaced by current time
+func (s *MemStorage) RestoreRecords(_ context.Context, records []model.MetricRecord) error {
+	now := time.Now()
+	for _, record := range records {
+		updated := record.UpdatedAt
+		if updated.IsZero() {
+			updated = now
+		}
+
+		sh := s.shard(record.ID)
+		sh.mu.Lock()
+		if record.MType == model.MetricTypeCounter && record.Delta != nil {
+			sh.counter[record.ID] = counterEntry{value: *record.Delta, updated: updated}
+		}
+		if record.MType == model.MetricTypeGauge && record.Value != nil {
+			sh.gauge[record.ID] = gaugeEntry{value: *record.Value, updated: updated}
+		}
+		sh.mu.Unlock()
+	}
+
+	return nil
+}
+
+// GetHistory
+// get points of metric history in resolution with given step
+func (s *MemStorage) GetHistory(_ context.Context, metricType string, name string, from, to time.Time, step time.Duration) ([]model.HistoryPoint, error) {
+	if s.history == nil {
+		return nil, nil
+	}
+
+	return s.history.Query(metricType, name, from, to, step)
+}
+
+// DeleteMetric
+// removes metric and its history by type and name
+func (s *MemStorage) DeleteMetric(_ context.Context, metricType string, name string) error {
+	sh := s.shard(name)
+	sh.mu.Lock()
+	var ok bool
+	switch metricType {
+	case model.MetricTypeGauge:
+		_, ok = sh.gauge[name]
+		delete(sh.gauge, name)
+	case model.MetricTypeCounter:
+		_, ok = sh.counter[name]
+		delete(sh.counter, name)
+	}
+	sh.mu.Unlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+	if s.history != nil {
+		s.history.Delete(metricType, name)
+	}
+
+	return nil
+}
+
+// DeleteStale
+// removes metrics not updated since before and returns their count
+func (s *MemStorage) DeleteStale(_ context.Context, before time.Time) (int, error) {
+	var stale []model.Metrics
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for name, entry := range sh.gauge {
+			if entry.updated.Before(before) {
+				delete(sh.gauge, name)
+				stale = append(stale, model.Metrics{ID: name, MType: model.MetricTypeGauge})
+			}
+		}
+		for name, entry := range sh.counter {
+			if entry.updated.Before(before) {
+				delete(sh.counter, name)
+				stale = append(stale, model.Metrics{ID: name, MType: model.MetricTypeCounter})
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	if s.history != nil {
+		for _, metric := range stale {
+			s.history.Delete(metric.MType, metric.ID)
+		}
+	}
+
+	return len(stale), nil
+}
+
 // Ping
 // verify if storage is in normal condition
-func (s *MemStorage) Ping() error {
+func (s *MemStorage) Ping(_ context.Context) error {
 	return nil
 }
@@ -0,0 +1,147 @@
+package memstorage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/history"
+	"github.com/derpartizanen/metrics/internal/interfaces"
+	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/internal/repository/repotest"
+)
+
+func TestMemStorage_Repository(t *testing.T) {
+	repotest.Run(t, func(_ *testing.T) interfaces.Repository {
+		return New()
+	}, ErrNotFound)
+}
+
+func TestMemStorage_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	const writers = 16
+	const updates = 1000
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				assert.NoError(t, s.UpdateCounterMetric(ctx, "PollCount", 1))
+				assert.NoError(t, s.UpdateGaugeMetric(ctx, fmt.Sprintf("Gauge%d", w), float64(i)))
+				_, _ = s.GetAllMetrics(ctx)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	count, err := s.GetCounterMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(writers*updates), count)
+
+	value, err := s.GetGaugeMetric(ctx, "Gauge0")
+	require.NoError(t, err)
+	assert.Equal(t, float64(updates-1), value)
+}
+
+func TestMemStorage_ConcurrentHistory(t *testing.T) {
+	ctx := context.Background()
+	s := New().WithHistory(history.NewStore(history.Resolutions(time.Minute, time.Hour, time.Hour)))
+
+	const writers = 16
+	const updates = 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				assert.NoError(t, s.UpdateCounterMetric(ctx, "PollCount", 1))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// totals reaching history out of order would be taken for counter resets
+	points, err := s.GetHistory(ctx, model.MetricTypeCounter, "PollCount", time.Now().Add(-time.Minute), time.Now().Add(time.Minute), 0)
+	require.NoError(t, err)
+	var increase int64
+	for _, point := range points {
+		increase += *point.Increase
+	}
+	assert.Equal(t, int64(writers*updates), increase)
+}
+
+func TestMemStorage_GetAllMetrics(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	require.NoError(t, s.UpdateGaugeMetric(ctx, "Alloc", 1.5))
+	require.NoError(t, s.UpdateGaugeMetric(ctx, "Sys", 2.5))
+	require.NoError(t, s.UpdateCounterMetric(ctx, "PollCount", 3))
+	require.NoError(t, s.UpdateCounterMetric(ctx, "Requests", 4))
+
+	metrics, err := s.GetAllMetrics(ctx)
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, metric := range metrics {
+		if metric.MType == model.MetricTypeGauge {
+			values[metric.ID] = *metric.Value
+		} else {
+			values[metric.ID] = float64(*metric.Delta)
+		}
+	}
+	assert.Equal(t, map[string]float64{"Alloc": 1.5, "Sys": 2.5, "PollCount": 3, "Requests": 4}, values)
+
+	_, err = s.GetGaugeMetric(ctx, "Unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func BenchmarkMemStorage_UpdateParallel(b *testing.B) {
+	ctx := context.Background()
+	s := New()
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = fmt.Sprintf("Metric%d", i)
+	}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			name := names[i%len(names)]
+			if i%2 == 0 {
+				_ = s.UpdateCounterMetric(ctx, name, 1)
+			} else {
+				_ = s.UpdateGaugeMetric(ctx, name, float64(i))
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMemStorage_SetAllMetricsParallel(b *testing.B) {
+	ctx := context.Background()
+	s := New()
+	metrics := make([]model.Metrics, 100)
+	for i := range metrics {
+		value := float64(i)
+		metrics[i] = model.Metrics{ID: fmt.Sprintf("Metric%d", i), MType: model.MetricTypeGauge, Value: &value}
+	}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = s.SetAllMetrics(ctx, metrics)
+		}
+	})
+}
@@ -0,0 +1,16 @@
+-- +goose Up
+ALTER TABLE metric ALTER COLUMN id TYPE VARCHAR(255);
+
+-- +goose Down
+-- ids longer than 30 characters do not fit the old column, rollback is refused
+-- until such metrics are deleted or renamed, so no data is lost silently
+-- +goose StatementBegin
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM metric WHERE length(id) > 30) THEN
+        RAISE EXCEPTION 'metric ids longer than 30 characters exist, delete them before rollback';
+    END IF;
+END
+$$;
+-- +goose StatementEnd
+ALTER TABLE metric ALTER COLUMN id TYPE VARCHAR(30);
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE metric ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- +goose Down
+ALTER TABLE metric DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS metric_sample
+(
+    id          VARCHAR(255) NOT NULL,
+    type        VARCHAR(20)  NOT NULL,
+    value       double precision,
+    delta       bigint,
+    recorded_at TIMESTAMPTZ  NOT NULL
+) PARTITION BY RANGE (recorded_at);
+
+CREATE INDEX IF NOT EXISTS metric_sample_id_recorded_at_idx ON metric_sample (id, recorded_at);
+
+-- rows outside of created partitions are kept here until partition job catches up
+CREATE TABLE IF NOT EXISTS metric_sample_default PARTITION OF metric_sample DEFAULT;
+
+-- +goose Down
+DROP TABLE IF EXISTS metric_sample;
@@ -0,0 +1,33 @@
+-- +goose Up
+ALTER TABLE metric_sample ADD COLUMN IF NOT EXISTS increment bigint;
+
+CREATE TABLE IF NOT EXISTS metric_rollup_1m
+(
+    id       VARCHAR(255) NOT NULL,
+    type     VARCHAR(20)  NOT NULL,
+    bucket   TIMESTAMPTZ  NOT NULL,
+    count    bigint       NOT NULL,
+    min      double precision,
+    max      double precision,
+    sum      double precision,
+    increase bigint,
+    PRIMARY KEY (id, type, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS metric_rollup_1h
+(
+    id       VARCHAR(255) NOT NULL,
+    type     VARCHAR(20)  NOT NULL,
+    bucket   TIMESTAMPTZ  NOT NULL,
+    count    bigint       NOT NULL,
+    min      double precision,
+    max      double precision,
+    sum      double precision,
+    increase bigint,
+    PRIMARY KEY (id, type, bucket)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS metric_rollup_1h;
+DROP TABLE IF EXISTS metric_rollup_1m;
+ALTER TABLE metric_sample DROP COLUMN IF EXISTS increment;
@@ -0,0 +1,190 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/logger"
+)
+
+const (
+	PartitionDay  = "day"
+	PartitionWeek = "week"
+)
+
+const (
+	// sampleTable is a parent of time partitions of metric history
+	sampleTable = "metric_sample"
+	// partitionsAhead is a number of future partitions created in advance
+	partitionsAhead = 2
+	// partitionJobInterval is a period of creating and dropping history partitions
+	partitionJobInterval = time.Hour
+	// partitionDateFormat is a suffix of partition name, it is a start of partition range
+	partitionDateFormat = "20060102"
+)
+
+var (
+	ErrInvalidPartition = errors.New("invalid history partition period")
+)
+
+// HistorySettings of metric samples table
+type HistorySettings struct {
+	// Partition is a period covered by one partition: day or week
+	Partition string
+	// Retention is a minimal age of dropped partitions, zero means history is kept forever
+	Retention time.Duration
+	// MinuteRetention and HourRetention are maximal ages of rollups, zero means rollups are kept forever
+	MinuteRetention time.Duration
+	HourRetention   time.Duration
+}
+
+// partitionRange is a time range of single history partition
+type partitionRange struct {
+	name  string
+	start time.Time
+	end   time.Time
+}
+
+// newPartitionRange
+// returns range of given period that contains t
+func newPartitionRange(period string, t time.Time) (partitionRange, error) {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch period {
+	case PartitionDay:
+		return partitionRange{
+			name:  fmt.Sprintf("%s_d%s", sampleTable, start.Format(partitionDateFormat)),
+			start: start,
+			end:   start.AddDate(0, 0, 1),
+		}, nil
+	case PartitionWeek:
+		// weeks start on monday
+		start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+		return partitionRange{
+			name:  fmt.Sprintf("%s_w%s", sampleTable, start.Format(partitionDateFormat)),
+			start: start,
+			end:   start.AddDate(0, 0, 7),
+		}, nil
+	}
+
+	return partitionRange{}, fmt.Errorf("%w '%s'", ErrInvalidPartition, period)
+}
+
+// parsePartitionName
+// restores range of partition by its name, false is returned for tables not created by partition job
+func parsePartitionName(name string) (partitionRange, bool) {
+	suffix, ok := strings.CutPrefix(name, sampleTable+"_")
+	if !ok || len(suffix) != len(partitionDateFormat)+1 {
+		return partitionRange{}, false
+	}
+
+	start, err := time.Parse(partitionDateFormat, suffix[1:])
+	if err != nil {
+		return partitionRange{}, false
+	}
+
+	period := map[byte]string{'d': PartitionDay, 'w': PartitionWeek}[suffix[0]]
+	r, err := newPartitionRange(period, start)
+	if err != nil || !r.start.Equal(start) {
+		return partitionRange{}, false
+	}
+
+	return r, true
+}
+
+// runPartitionJob
+// maintains history partitions until context is canceled or storage is closed
+func (s *PgStorage) runPartitionJob(ctx context.Context) {
+	ticker := time.NewTicker(partitionJobInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.maintainPartitions(ctx, time.Now()); err != nil {
+				logger.Log.Error("History partitions maintenance failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// maintainPartitions
+// creates partitions of current and next periods and drops partitions older than retention
+func (s *PgStorage) maintainPartitions(ctx context.Context, now time.Time) error {
+	r, err := newPartitionRange(s.history.Partition, now)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i <= partitionsAhead; i++ {
+		query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+			r.name, sampleTable, r.start.Format(time.RFC3339), r.end.Format(time.RFC3339))
+		if _, err := s.pool.Exec(ctx, query); err != nil {
+			// partition of other period may already cover the range, samples go to default partition then
+			logger.Log.Warn("Create history partition failed", zap.String("partition", r.name), zap.Error(err))
+		}
+
+		r, err = newPartitionRange(s.history.Partition, r.end)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.history.Retention <= 0 {
+		return nil
+	}
+
+	return s.dropPartitions(ctx, now.Add(-s.history.Retention))
+}
+
+// dropPartitions
+// drops partitions which end before cutoff and removes the same old samples from default partition
+func (s *PgStorage) dropPartitions(ctx context.Context, cutoff time.Time) error {
+	query := `
+		SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = $1
+	`
+	rows, err := s.pool.Query(ctx, query, sampleTable)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+
+		if r, ok := parsePartitionName(name); ok && !r.end.After(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range expired {
+		if _, err := s.pool.Exec(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, name)); err != nil {
+			return err
+		}
+		logger.Log.Info("Dropped history partition", zap.String("partition", name))
+	}
+
+	_, err = s.pool.Exec(ctx, `DELETE FROM metric_sample_default WHERE recorded_at < $1`, cutoff)
+
+	return err
+}
@@ -0,0 +1,39 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPartitionRange(t *testing.T) {
+	// sunday evening
+	at := time.Date(2026, 10, 18, 23, 30, 0, 0, time.UTC)
+
+	day, err := newPartitionRange(PartitionDay, at)
+	require.NoError(t, err)
+	assert.Equal(t, "metric_sample_d20261018", day.name)
+	assert.Equal(t, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), day.end)
+
+	week, err := newPartitionRange(PartitionWeek, at)
+	require.NoError(t, err)
+	assert.Equal(t, "metric_sample_w20261012", week.name)
+	assert.Equal(t, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), week.end)
+
+	_, err = newPartitionRange("month", at)
+	assert.ErrorIs(t, err, ErrInvalidPartition)
+}
+
+func TestParsePartitionName(t *testing.T) {
+	r, ok := parsePartitionName("metric_sample_w20261012")
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), r.start)
+	assert.Equal(t, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), r.end)
+
+	for _, name := range []string{"metric_sample_default", "metric_sample_w20261013", "metric_sample_x20261012", "metric"} {
+		_, ok := parsePartitionName(name)
+		assert.False(t, ok, name)
+	}
+}
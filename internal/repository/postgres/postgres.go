@@ -6,12 +6,16 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/avast/retry-go"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/pressly/goose/v3"
 
 	"github.com/derpartizanen/metrics/internal/logger"
@@ -26,44 +30,92 @@ const (
 )
 
 type PgStorage struct {
-	db  *sql.DB
-	ctx context.Context
+	pool      *pgxpool.Pool
+	history   HistorySettings
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// New connects to database by passed dsn and returning PgStorage type
-func New(ctx context.Context, dsn string) (*PgStorage, error) {
-	db, err := sql.Open("pgx", dsn)
+// PoolSettings limits connections of database pool, zero values keep pgxpool defaults
+type PoolSettings struct {
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+}
+
+// New connects to database by passed dsn and returning PgStorage type.
+// History partitions are created at once and then maintained in background until Close
+func New(ctx context.Context, dsn string, settings PoolSettings, history HistorySettings) (*PgStorage, error) {
+	if _, err := newPartitionRange(history.Partition, time.Now()); err != nil {
+		return nil, err
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if settings.MaxConns > 0 {
+		poolConfig.MaxConns = settings.MaxConns
+	}
+	if settings.MinConns > 0 {
+		poolConfig.MinConns = settings.MinConns
+	}
+	if settings.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = settings.MaxConnLifetime
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	err = applyMigrations(db)
+	err = pool.Ping(ctx)
 	if err != nil {
+		pool.Close()
 		return nil, err
 	}
 
-	err = db.Ping()
+	err = applyMigrations(pool)
 	if err != nil {
+		pool.Close()
 		return nil, err
 	}
 
-	return &PgStorage{db: db, ctx: ctx}, nil
+	s := &PgStorage{pool: pool, history: history, done: make(chan struct{})}
+	err = s.maintainPartitions(ctx, time.Now())
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	go s.runPartitionJob(ctx)
+	go s.runRollupJob(ctx)
+
+	return s, nil
+}
+
+// Close stops partition job and closes all connections of pool
+func (s *PgStorage) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.pool.Close()
+	})
 }
 
 // UpdateGaugeMetric sets value for gauge metric
-func (s *PgStorage) UpdateGaugeMetric(name string, value float64) error {
-	query := `INSERT INTO metric (id, type, value, delta) VALUES ($1, $2, $3, $4)
-              ON CONFLICT (id) DO UPDATE SET value = EXCLUDED.value`
+func (s *PgStorage) UpdateGaugeMetric(ctx context.Context, name string, value float64) error {
+	query := withSample(`INSERT INTO metric (id, type, value, delta) VALUES ($1, $2, $3, $4)
+              ON CONFLICT (id) DO UPDATE SET value = EXCLUDED.value, updated_at = NOW()`)
 
 	var err error
 	_ = retry.Do(
 		func() error {
-			_, err = s.db.ExecContext(s.ctx, query, name, model.MetricTypeGauge, value, nil)
+			_, err = s.pool.Exec(ctx, query, name, model.MetricTypeGauge, value, nil)
 			if isRetryableError(err) {
 				return err
 			}
 			return nil
 		},
+		retry.Context(ctx),
 		retry.Attempts(retryAttempts),
 		retry.DelayType(retryDelayType),
 		retry.OnRetry(func(n uint, err error) {
@@ -75,19 +127,20 @@ func (s *PgStorage) UpdateGaugeMetric(name string, value float64) error {
 }
 
 // UpdateCounterMetric sets value for counter metric
-func (s *PgStorage) UpdateCounterMetric(name string, value int64) error {
-	query := `INSERT INTO metric (id, type, value, delta) VALUES ($1, $2, $3, $4)
-              ON CONFLICT (id) DO UPDATE SET delta = metric.delta + EXCLUDED.delta`
+func (s *PgStorage) UpdateCounterMetric(ctx context.Context, name string, value int64) error {
+	query := withSample(`INSERT INTO metric (id, type, value, delta) VALUES ($1, $2, $3, $4)
+              ON CONFLICT (id) DO UPDATE SET delta = metric.delta + EXCLUDED.delta, updated_at = NOW()`)
 
 	var err error
 	_ = retry.Do(
 		func() error {
-			_, err := s.db.ExecContext(s.ctx, query, name, model.MetricTypeCounter, nil, value)
+			_, err = s.pool.Exec(ctx, query, name, model.MetricTypeCounter, nil, value)
 			if isRetryableError(err) {
 				return err
 			}
 			return nil
 		},
+		retry.Context(ctx),
 		retry.Attempts(retryAttempts),
 		retry.DelayType(retryDelayType),
 		retry.OnRetry(func(n uint, err error) {
@@ -98,11 +151,37 @@ func (s *PgStorage) UpdateCounterMetric(name string, value int64) error {
 	return err
 }
 
+// resetCounterQuery replaces counter value, history sample of reset has increment equal to the new value
+var resetCounterQuery = withSample(`INSERT INTO metric (id, type, value, delta) VALUES ($1, $2, $3, $4)
+              ON CONFLICT (id) DO UPDATE SET delta = EXCLUDED.delta, updated_at = NOW()`)
+
+// ResetCounterMetric sets value for counter metric replacing accumulated one
+func (s *PgStorage) ResetCounterMetric(ctx context.Context, name string, value int64) error {
+	var err error
+	_ = retry.Do(
+		func() error {
+			_, err = s.pool.Exec(ctx, resetCounterQuery, name, model.MetricTypeCounter, nil, value)
+			if isRetryableError(err) {
+				return err
+			}
+			return nil
+		},
+		retry.Context(ctx),
+		retry.Attempts(retryAttempts),
+		retry.DelayType(retryDelayType),
+		retry.OnRetry(func(n uint, err error) {
+			logger.Log.Error(fmt.Sprintf("retry #%d to reset counter metric", n))
+		}),
+	)
+
+	return err
+}
+
 // GetGaugeMetric retrieve value of gauge metric
-func (s *PgStorage) GetGaugeMetric(metricName string) (float64, error) {
+func (s *PgStorage) GetGaugeMetric(ctx context.Context, metricName string) (float64, error) {
 	var value sql.NullFloat64
 	query := `SELECT value FROM metric WHERE type = 'gauge' and id = $1`
-	row := s.db.QueryRowContext(s.ctx, query, metricName)
+	row := s.pool.QueryRow(ctx, query, metricName)
 	err := row.Scan(&value)
 	if err != nil {
 		return 0, err
@@ -116,10 +195,10 @@ func (s *PgStorage) GetGaugeMetric(metricName string) (float64, error) {
 }
 
 // GetCounterMetric retrieve value of counter metric
-func (s *PgStorage) GetCounterMetric(metricName string) (int64, error) {
+func (s *PgStorage) GetCounterMetric(ctx context.Context, metricName string) (int64, error) {
 	var delta sql.NullInt64
 	query := `SELECT delta FROM metric WHERE type = 'counter' and id = $1`
-	row := s.db.QueryRowContext(s.ctx, query, metricName)
+	row := s.pool.QueryRow(ctx, query, metricName)
 	err := row.Scan(&delta)
 	if err != nil {
 		return 0, err
@@ -132,11 +211,11 @@ func (s *PgStorage) GetCounterMetric(metricName string) (int64, error) {
 	return delta.Int64, nil
 }
 
-// GetAllMetrics retrieve values of both counter and gauge metric types
-func (s *PgStorage) GetAllMetrics() ([]model.Metrics, error) {
+// GetAllMetrics retrieve values of both counter and gauge metric types sorted by name, gauges go first
+func (s *PgStorage) GetAllMetrics(ctx context.Context) ([]model.Metrics, error) {
 	var metrics []model.Metrics
-	query := `SELECT id, type, value, delta FROM metric`
-	rows, err := s.db.QueryContext(s.ctx, query)
+	query := `SELECT id, type, value, delta FROM metric ORDER BY type DESC, id`
+	rows, err := s.pool.Query(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -160,41 +239,138 @@ func (s *PgStorage) GetAllMetrics() ([]model.Metrics, error) {
 	return metrics, nil
 }
 
-// SetAllMetrics set values for both counter and gauge metric types
-func (s *PgStorage) SetAllMetrics(metrics []model.Metrics) error {
-	tx, err := s.db.Begin()
+// SetAllMetrics set values for both counter and gauge metric types, counters with reset flag are replaced.
+// Upserts are queued in one batch, so the whole slice is sent in a single round trip
+// and applied in implicit transaction
+func (s *PgStorage) SetAllMetrics(ctx context.Context, metrics []model.Metrics) error {
+	query := withSample(`
+		INSERT INTO metric (id, type, value, delta) VALUES($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET delta = metric.delta + EXCLUDED.delta, value = EXCLUDED.value, updated_at = NOW()
+	`)
+
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, m := range metrics {
+		if m.Reset && m.MType == model.MetricTypeCounter {
+			batch.Queue(resetCounterQuery, m.ID, m.MType, nil, m.Delta)
+			continue
+		}
+		batch.Queue(query, m.ID, m.MType, m.Value, m.Delta)
+	}
+
+	return s.pool.SendBatch(ctx, batch).Close()
+}
+
+// GetRecord retrieve value of metric with time of its last update
+func (s *PgStorage) GetRecord(ctx context.Context, metricType string, name string) (model.MetricRecord, error) {
+	var r model.MetricRecord
+	query := `SELECT id, type, value, delta, updated_at FROM metric WHERE type = $1 AND id = $2`
+	row := s.pool.QueryRow(ctx, query, metricType, name)
+	err := row.Scan(&r.ID, &r.MType, &r.Value, &r.Delta, &r.UpdatedAt)
 	if err != nil {
-		return err
+		return model.MetricRecord{}, err
+	}
+
+	if r.Value == nil && r.Delta == nil {
+		return model.MetricRecord{}, sql.ErrNoRows
+	}
+
+	return r, nil
+}
+
+// GetAllRecords retrieve values of all metrics with time of their last update
+func (s *PgStorage) GetAllRecords(ctx context.Context) ([]model.MetricRecord, error) {
+	var records []model.MetricRecord
+	query := `SELECT id, type, value, delta, updated_at FROM metric ORDER BY type DESC, id`
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
 	}
-	defer tx.Rollback()
+	defer rows.Close()
+
+	for rows.Next() {
+		var r model.MetricRecord
+		err = rows.Scan(&r.ID, &r.MType, &r.Value, &r.Delta, &r.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, r)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
 
+// RestoreRecords set values of metrics and time of their last update, counters are replaced rather than increased.
+// Records are sent in a single batch like in SetAllMetrics
+func (s *PgStorage) RestoreRecords(ctx context.Context, records []model.MetricRecord) error {
 	query := `
-		INSERT INTO metric (id, type, value, delta) VALUES($1, $2, $3, $4)
-		ON CONFLICT (id) DO UPDATE SET delta = metric.delta + EXCLUDED.delta, value = EXCLUDED.value
+		INSERT INTO metric (id, type, value, delta, updated_at) VALUES($1, $2, $3, $4, COALESCE($5, NOW()))
+		ON CONFLICT (id) DO UPDATE SET type = EXCLUDED.type, delta = EXCLUDED.delta, value = EXCLUDED.value,
+			updated_at = EXCLUDED.updated_at
 	`
 
-	stmt, err := tx.PrepareContext(s.ctx, query)
+	batch := &pgx.Batch{}
+	for _, r := range records {
+		if r.MType != model.MetricTypeCounter && r.MType != model.MetricTypeGauge {
+			continue
+		}
+
+		var updatedAt *time.Time
+		if !r.UpdatedAt.IsZero() {
+			updatedAt = &r.UpdatedAt
+		}
+
+		batch.Queue(query, r.ID, r.MType, r.Value, r.Delta, updatedAt)
+	}
+
+	return s.pool.SendBatch(ctx, batch).Close()
+}
+
+// DeleteMetric removes metric by type and name, sql.ErrNoRows is returned if there is no such metric.
+// History samples are kept until retention
+func (s *PgStorage) DeleteMetric(ctx context.Context, metricType string, name string) error {
+	query := `DELETE FROM metric WHERE id = $1 AND type = $2`
+	tag, err := s.pool.Exec(ctx, query, name, metricType)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	for _, m := range metrics {
-		_, err := stmt.ExecContext(s.ctx, m.ID, m.MType, m.Value, m.Delta)
-		if err != nil {
-			return err
-		}
+	if tag.RowsAffected() == 0 {
+		return sql.ErrNoRows
 	}
 
-	return tx.Commit()
+	return nil
+}
+
+// DeleteStale removes metrics not updated since before and returns their count
+func (s *PgStorage) DeleteStale(ctx context.Context, before time.Time) (int, error) {
+	query := `DELETE FROM metric WHERE updated_at < $1`
+	tag, err := s.pool.Exec(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), nil
 }
 
 // Ping check connection with database
-func (s *PgStorage) Ping() error {
-	return s.db.Ping()
+func (s *PgStorage) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
 }
 
-func applyMigrations(db *sql.DB) error {
+func applyMigrations(pool *pgxpool.Pool) error {
+	db := stdlib.OpenDBFromPool(pool)
+	defer db.Close()
+
 	goose.SetBaseFS(embedMigrations)
 
 	if err := goose.SetDialect("postgres"); err != nil {
@@ -208,6 +384,15 @@ func applyMigrations(db *sql.DB) error {
 	return nil
 }
 
+// withSample
+// extends metric upsert query to record updated metric into history,
+// upsert parameter $4 is a counter increment
+func withSample(upsert string) string {
+	return `WITH m AS (` + upsert + ` RETURNING id, type, value, delta, updated_at)
+		INSERT INTO metric_sample (id, type, value, delta, increment, recorded_at)
+		SELECT id, type, value, delta, $4::bigint, updated_at FROM m`
+}
+
 func isRetryableError(err error) bool {
 	var pgErr *pgconn.PgError
 	if err != nil && errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
@@ -0,0 +1,33 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/interfaces"
+	"github.com/derpartizanen/metrics/internal/repository/repotest"
+)
+
+// TestPgStorage_Repository runs against database of TEST_DATABASE_DSN, all metrics of the database are removed
+func TestPgStorage_Repository(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	repotest.Run(t, func(t *testing.T) interfaces.Repository {
+		ctx := context.Background()
+		s, err := New(ctx, dsn, PoolSettings{}, HistorySettings{Partition: PartitionDay})
+		require.NoError(t, err)
+		t.Cleanup(s.Close)
+
+		_, err = s.pool.Exec(ctx, `TRUNCATE metric, metric_sample, metric_rollup_1m, metric_rollup_1h`)
+		require.NoError(t, err)
+
+		return s
+	}, sql.ErrNoRows)
+}
@@ -0,0 +1,190 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/history"
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// rollupJobInterval is a period of aggregating samples into rollups
+const rollupJobInterval = time.Minute
+
+// sampleIncreaseQuery
+// selects samples matching filter with increase of counters computed from consecutive totals.
+// Decreased total means counter was reset, so its increase is the whole new total and never negative.
+// The first sample has no previous total in range, its increment is used instead
+func sampleIncreaseQuery(filter string) string {
+	return `
+		SELECT id, type, value, recorded_at,
+			CASE
+				WHEN prev IS NULL THEN increment
+				WHEN delta < prev THEN delta
+				ELSE delta - prev
+			END AS increase
+		FROM (
+			SELECT id, type, value, delta, increment, recorded_at,
+				lag(delta) OVER (PARTITION BY id, type ORDER BY recorded_at) AS prev
+			FROM metric_sample WHERE ` + filter + `
+		) totals
+	`
+}
+
+// rollupTables maps step of history resolution to table with its points, raw samples have zero step
+var rollupTables = map[time.Duration]string{
+	time.Minute: "metric_rollup_1m",
+	time.Hour:   "metric_rollup_1h",
+}
+
+// runRollupJob
+// aggregates history into rollups and removes expired rollups until context is canceled or storage is closed
+func (s *PgStorage) runRollupJob(ctx context.Context) {
+	ticker := time.NewTicker(rollupJobInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.rollup(ctx, time.Now()); err != nil {
+				logger.Log.Error("History rollup failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// rollup
+// recomputes minute rollups from raw samples and hour rollups from minute ones, starting with
+// the last stored bucket, so the current bucket is refreshed and gaps after downtime are filled
+func (s *PgStorage) rollup(ctx context.Context, now time.Time) error {
+	minuteQuery := `
+		INSERT INTO metric_rollup_1m (id, type, bucket, count, min, max, sum, increase)
+		SELECT id, type, date_trunc('minute', recorded_at, 'UTC'), count(*), min(value), max(value), sum(value), sum(increase)
+		FROM (` + sampleIncreaseQuery("recorded_at >= $1") + `) samples
+		GROUP BY id, type, date_trunc('minute', recorded_at, 'UTC')
+		ON CONFLICT (id, type, bucket) DO UPDATE SET count = EXCLUDED.count, min = EXCLUDED.min, max = EXCLUDED.max,
+			sum = EXCLUDED.sum, increase = EXCLUDED.increase
+	`
+	if err := s.rollupFrom(ctx, "metric_rollup_1m", minuteQuery, since(now, s.history.Retention)); err != nil {
+		return fmt.Errorf("minute rollup: %w", err)
+	}
+
+	hourQuery := `
+		INSERT INTO metric_rollup_1h (id, type, bucket, count, min, max, sum, increase)
+		SELECT id, type, date_trunc('hour', bucket, 'UTC'), sum(count), min(min), max(max), sum(sum), sum(increase)
+		FROM metric_rollup_1m WHERE bucket >= $1
+		GROUP BY id, type, date_trunc('hour', bucket, 'UTC')
+		ON CONFLICT (id, type, bucket) DO UPDATE SET count = EXCLUDED.count, min = EXCLUDED.min, max = EXCLUDED.max,
+			sum = EXCLUDED.sum, increase = EXCLUDED.increase
+	`
+	if err := s.rollupFrom(ctx, "metric_rollup_1h", hourQuery, since(now, s.history.MinuteRetention)); err != nil {
+		return fmt.Errorf("hour rollup: %w", err)
+	}
+
+	retentions := map[string]time.Duration{
+		"metric_rollup_1m": s.history.MinuteRetention,
+		"metric_rollup_1h": s.history.HourRetention,
+	}
+	for table, retention := range retentions {
+		if retention <= 0 {
+			continue
+		}
+		_, err := s.pool.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE bucket < $1`, table), now.Add(-retention))
+		if err != nil {
+			return fmt.Errorf("expire %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+// rollupFrom
+// runs aggregation query from the last bucket of table, or from fallback if table is empty
+func (s *PgStorage) rollupFrom(ctx context.Context, table string, query string, fallback time.Time) error {
+	var last *time.Time
+	err := s.pool.QueryRow(ctx, fmt.Sprintf(`SELECT max(bucket) FROM %s`, table)).Scan(&last)
+	if err != nil {
+		return err
+	}
+
+	from := fallback
+	if last != nil {
+		from = *last
+	}
+
+	_, err = s.pool.Exec(ctx, query, from)
+
+	return err
+}
+
+// since
+// returns the oldest time kept by retention, zero time if history is kept forever
+func since(now time.Time, retention time.Duration) time.Time {
+	if retention <= 0 {
+		return time.Time{}
+	}
+
+	return now.Add(-retention)
+}
+
+// GetHistory retrieve points of metric history in resolution with given step, raw samples are points with count 1.
+// Raw samples are selected by time range, so only partitions of the range are scanned
+func (s *PgStorage) GetHistory(ctx context.Context, metricType string, name string, from, to time.Time, step time.Duration) ([]model.HistoryPoint, error) {
+	query := `SELECT recorded_at, 1, value, value, value, increase FROM (` +
+		sampleIncreaseQuery("id = $1 AND type = $2 AND recorded_at >= $3 AND recorded_at < $4") + `) samples
+              ORDER BY recorded_at`
+	if step != 0 {
+		table, ok := rollupTables[step]
+		if !ok {
+			return nil, history.ErrInvalidResolution
+		}
+		query = fmt.Sprintf(`SELECT bucket, count, min, max, sum, increase FROM %s
+              WHERE id = $1 AND type = $2 AND bucket >= $3 AND bucket < $4 ORDER BY bucket`, table)
+		from = from.Truncate(step)
+	}
+
+	rows, err := s.pool.Query(ctx, query, name, metricType, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []model.HistoryPoint
+	for rows.Next() {
+		var p model.HistoryPoint
+		err = rows.Scan(&p.Time, &p.Count, &p.Min, &p.Max, &p.Sum, &p.Increase)
+		if err != nil {
+			return nil, err
+		}
+
+		if metricType == model.MetricTypeCounter {
+			p.Min, p.Max, p.Sum = nil, nil, nil
+			if p.Increase == nil {
+				p.Increase = new(int64)
+			}
+		} else {
+			p.Increase = nil
+			if p.Sum != nil && p.Count > 0 {
+				avg := *p.Sum / float64(p.Count)
+				p.Avg = &avg
+			}
+		}
+
+		points = append(points, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
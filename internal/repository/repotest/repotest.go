@@ -0,0 +1,218 @@
+// Package repotest is a conformance suite of interfaces.Repository implementations.
+package repotest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/interfaces"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// Run
+// runs the suite, newRepo must return an empty repository for every subtest,
+// notFound is an error returned by repository for unknown metrics
+func Run(t *testing.T, newRepo func(t *testing.T) interfaces.Repository, notFound error) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo interfaces.Repository, notFound error)
+	}{
+		{name: "update and get", test: testUpdate},
+		{name: "not found", test: testNotFound},
+		{name: "get record", test: testGetRecord},
+		{name: "reset counter", test: testResetCounter},
+		{name: "set all metrics", test: testSetAllMetrics},
+		{name: "restore records", test: testRestoreRecords},
+		{name: "delete metric", test: testDeleteMetric},
+		{name: "delete stale", test: testDeleteStale},
+		{name: "concurrent updates", test: testConcurrent},
+		{name: "ping", test: testPing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t), notFound)
+		})
+	}
+}
+
+func testUpdate(t *testing.T, repo interfaces.Repository, _ error) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateGaugeMetric(ctx, "Alloc", 1.5))
+	require.NoError(t, repo.UpdateGaugeMetric(ctx, "Alloc", 2.5))
+	require.NoError(t, repo.UpdateCounterMetric(ctx, "PollCount", 3))
+	require.NoError(t, repo.UpdateCounterMetric(ctx, "PollCount", 4))
+
+	value, err := repo.GetGaugeMetric(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, value)
+
+	count, err := repo.GetCounterMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), count)
+
+	gauge, delta := 2.5, int64(7)
+	metrics, err := repo.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []model.Metrics{
+		{ID: "Alloc", MType: model.MetricTypeGauge, Value: &gauge},
+		{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta},
+	}, metrics)
+}
+
+func testNotFound(t *testing.T, repo interfaces.Repository, notFound error) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateGaugeMetric(ctx, "Alloc", 1))
+
+	_, err := repo.GetGaugeMetric(ctx, "Unknown")
+	assert.ErrorIs(t, err, notFound)
+
+	// metrics of different types do not share names
+	_, err = repo.GetCounterMetric(ctx, "Alloc")
+	assert.ErrorIs(t, err, notFound)
+}
+
+func testGetRecord(t *testing.T, repo interfaces.Repository, notFound error) {
+	ctx := context.Background()
+	before := time.Now().Add(-time.Second)
+	require.NoError(t, repo.UpdateGaugeMetric(ctx, "Alloc", 1.5))
+
+	record, err := repo.GetRecord(ctx, model.MetricTypeGauge, "Alloc")
+	require.NoError(t, err)
+	gauge := 1.5
+	assert.Equal(t, model.Metrics{ID: "Alloc", MType: model.MetricTypeGauge, Value: &gauge}, record.Metrics)
+	assert.True(t, record.UpdatedAt.After(before), "updated at %s", record.UpdatedAt)
+
+	_, err = repo.GetRecord(ctx, model.MetricTypeCounter, "Alloc")
+	assert.ErrorIs(t, err, notFound)
+}
+
+func testResetCounter(t *testing.T, repo interfaces.Repository, _ error) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateCounterMetric(ctx, "PollCount", 10))
+	require.NoError(t, repo.ResetCounterMetric(ctx, "PollCount", 2))
+	require.NoError(t, repo.UpdateCounterMetric(ctx, "PollCount", 1))
+
+	count, err := repo.GetCounterMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+}
+
+func testSetAllMetrics(t *testing.T, repo interfaces.Repository, notFound error) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateCounterMetric(ctx, "Requests", 100))
+
+	gauge, delta, reset := 1.5, int64(5), int64(1)
+	require.NoError(t, repo.SetAllMetrics(ctx, []model.Metrics{
+		{ID: "Alloc", MType: model.MetricTypeGauge, Value: &gauge},
+		{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta},
+		{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta},
+		{ID: "Requests", MType: model.MetricTypeCounter, Delta: &reset, Reset: true},
+		// metrics without values are skipped
+		{ID: "Empty", MType: model.MetricTypeGauge},
+	}))
+
+	value, err := repo.GetGaugeMetric(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+
+	count, err := repo.GetCounterMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), count)
+
+	count, err = repo.GetCounterMetric(ctx, "Requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	_, err = repo.GetGaugeMetric(ctx, "Empty")
+	assert.ErrorIs(t, err, notFound)
+}
+
+func testRestoreRecords(t *testing.T, repo interfaces.Repository, _ error) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateCounterMetric(ctx, "PollCount", 100))
+
+	updated := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	gauge, delta := 1.5, int64(5)
+	require.NoError(t, repo.RestoreRecords(ctx, []model.MetricRecord{
+		{Metrics: model.Metrics{ID: "Alloc", MType: model.MetricTypeGauge, Value: &gauge}, UpdatedAt: updated},
+		{Metrics: model.Metrics{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta}, UpdatedAt: updated},
+	}))
+
+	// restored counters are replaced rather than increased
+	records, err := repo.GetAllRecords(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, model.Metrics{ID: "Alloc", MType: model.MetricTypeGauge, Value: &gauge}, records[0].Metrics)
+	assert.Equal(t, model.Metrics{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta}, records[1].Metrics)
+	for _, record := range records {
+		assert.True(t, updated.Equal(record.UpdatedAt), "%s updated at %s", record.ID, record.UpdatedAt)
+	}
+}
+
+func testDeleteMetric(t *testing.T, repo interfaces.Repository, notFound error) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateGaugeMetric(ctx, "Alloc", 1))
+	require.NoError(t, repo.UpdateCounterMetric(ctx, "Alloc", 1))
+
+	require.NoError(t, repo.DeleteMetric(ctx, model.MetricTypeGauge, "Alloc"))
+	err := repo.DeleteMetric(ctx, model.MetricTypeGauge, "Alloc")
+	assert.ErrorIs(t, err, notFound)
+
+	_, err = repo.GetGaugeMetric(ctx, "Alloc")
+	assert.ErrorIs(t, err, notFound)
+
+	count, err := repo.GetCounterMetric(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func testDeleteStale(t *testing.T, repo interfaces.Repository, _ error) {
+	ctx := context.Background()
+	value := 1.0
+	require.NoError(t, repo.RestoreRecords(ctx, []model.MetricRecord{
+		{Metrics: model.Metrics{ID: "Old", MType: model.MetricTypeGauge, Value: &value}, UpdatedAt: time.Now().Add(-2 * time.Hour)},
+	}))
+	require.NoError(t, repo.UpdateGaugeMetric(ctx, "Fresh", 2))
+
+	count, err := repo.DeleteStale(ctx, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	metrics, err := repo.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "Fresh", metrics[0].ID)
+}
+
+func testConcurrent(t *testing.T, repo interfaces.Repository, _ error) {
+	ctx := context.Background()
+
+	const writers = 8
+	const updates = 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				assert.NoError(t, repo.UpdateCounterMetric(ctx, "PollCount", 1))
+			}
+		}()
+	}
+	wg.Wait()
+
+	count, err := repo.GetCounterMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(writers*updates), count)
+}
+
+func testPing(t *testing.T, repo interfaces.Repository, _ error) {
+	assert.NoError(t, repo.Ping(context.Background()))
+}
@@ -0,0 +1,99 @@
+// Package snapshot defines versioned file format of stored metrics.
+// Decoding is forward-compatible: unknown fields are ignored, so snapshots written by newer servers
+// can be restored as long as they keep the fields of current version
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// FormatVersion is a version of snapshot written by this server,
+// version 0 is a legacy bare json array of metrics
+const FormatVersion = 1
+
+var (
+	ErrCountMismatch = errors.New("snapshot metric count mismatch")
+	ErrInvalidFormat = errors.New("invalid snapshot format")
+)
+
+// Snapshot is an envelope of stored metrics,
+// WALSequence is a sequence of the last write-ahead log record saved in it
+type Snapshot struct {
+	Version       int                  `json:"version"`
+	CreatedAt     time.Time            `json:"created_at"`
+	ServerVersion string               `json:"server_version"`
+	Count         int                  `json:"count"`
+	WALSequence   uint64               `json:"wal_sequence,omitempty"`
+	Metrics       []model.MetricRecord `json:"metrics"`
+}
+
+// New
+// creates snapshot of records in current format
+func New(records []model.MetricRecord, serverVersion string) *Snapshot {
+	if records == nil {
+		records = []model.MetricRecord{}
+	}
+
+	return &Snapshot{
+		Version:       FormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		ServerVersion: serverVersion,
+		Count:         len(records),
+		Metrics:       records,
+	}
+}
+
+// Encode
+// returns indented json of snapshot
+func (s *Snapshot) Encode() ([]byte, error) {
+	return json.MarshalIndent(s, "", "    ")
+}
+
+// Newer
+// reports whether snapshot was written in a format newer than the one known to this server
+func (s *Snapshot) Newer() bool {
+	return s.Version > FormatVersion
+}
+
+// Decode
+// parses snapshot of any version, legacy json array is converted to snapshot of version 0
+// with unknown update time of metrics
+func Decode(data []byte) (*Snapshot, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, ErrInvalidFormat
+	}
+
+	if trimmed[0] == '[' {
+		var metrics []model.Metrics
+		if err := json.Unmarshal(trimmed, &metrics); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidFormat, err)
+		}
+
+		records := make([]model.MetricRecord, 0, len(metrics))
+		for _, metric := range metrics {
+			records = append(records, model.MetricRecord{Metrics: metric})
+		}
+
+		return &Snapshot{Version: 0, Count: len(records), Metrics: records}, nil
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(trimmed, &s); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidFormat, err)
+	}
+	if s.Version < 1 {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalidFormat, s.Version)
+	}
+	if s.Count != len(s.Metrics) {
+		return nil, fmt.Errorf("%w: header %d, metrics %d", ErrCountMismatch, s.Count, len(s.Metrics))
+	}
+
+	return &s, nil
+}
@@ -0,0 +1,77 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+func TestSnapshot_EncodeDecode(t *testing.T) {
+	delta := int64(5)
+	s := New([]model.MetricRecord{{Metrics: model.Metrics{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta}}}, "v1.0.0")
+
+	data, err := s.Encode()
+	require.NoError(t, err)
+
+	decoded, err := Decode(data)
+	require.NoError(t, err)
+	assert.Equal(t, FormatVersion, decoded.Version)
+	assert.Equal(t, "v1.0.0", decoded.ServerVersion)
+	assert.Equal(t, 1, decoded.Count)
+	assert.Equal(t, int64(5), *decoded.Metrics[0].Delta)
+	assert.False(t, decoded.Newer())
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantErr   error
+		wantCount int
+		wantNewer bool
+	}{
+		{
+			name:      "legacy array",
+			data:      `[{"id":"Alloc","type":"gauge","value":1.5},{"id":"PollCount","type":"counter","delta":2}]`,
+			wantCount: 2,
+		},
+		{
+			name: "newer version with unknown fields",
+			data: `{"version":2,"created_at":"2026-01-02T03:04:05Z","count":1,"labels":{"dc":"eu"},
+				"metrics":[{"id":"Alloc","type":"gauge","value":1.5,"updated_at":"2026-01-02T03:04:05Z","unit":"bytes"}]}`,
+			wantCount: 1,
+			wantNewer: true,
+		},
+		{
+			name:    "count mismatch",
+			data:    `{"version":1,"count":2,"metrics":[{"id":"Alloc","type":"gauge","value":1.5}]}`,
+			wantErr: ErrCountMismatch,
+		},
+		{
+			name:    "missing version",
+			data:    `{"count":0,"metrics":[]}`,
+			wantErr: ErrInvalidFormat,
+		},
+		{
+			name:    "truncated",
+			data:    `{"version":1,"count":1,"metr`,
+			wantErr: ErrInvalidFormat,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := Decode([]byte(test.data))
+			if test.wantErr != nil {
+				assert.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, s.Metrics, test.wantCount)
+			assert.Equal(t, test.wantNewer, s.Newer())
+		})
+	}
+}
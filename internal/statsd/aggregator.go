@@ -0,0 +1,170 @@
+package statsd
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// timerQuantiles are reported for every timer and histogram as separate gauges
+var timerQuantiles = []struct {
+	suffix string
+	q      float64
+}{
+	{suffix: "_p50", q: 0.5},
+	{suffix: "_p90", q: 0.9},
+	{suffix: "_p99", q: 0.99},
+}
+
+// gaugeIdleFlushes is a number of flushes without updates after which gauge is forgotten
+const gaugeIdleFlushes = 10
+
+// Aggregator accumulates samples between flushes
+type Aggregator struct {
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	updated  map[string]struct{}
+	// idle is a number of flushes since the last update of gauge
+	idle   map[string]int
+	timers map[string]*timer
+	sets   map[string]map[string]struct{}
+}
+
+type timer struct {
+	values []float64
+	count  float64
+}
+
+// NewAggregator
+// creates empty aggregator
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		updated:  make(map[string]struct{}),
+		idle:     make(map[string]int),
+		timers:   make(map[string]*timer),
+		sets:     make(map[string]map[string]struct{}),
+	}
+}
+
+// Add
+// aggregates sample into current window
+func (a *Aggregator) Add(s Sample) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := s.Key()
+	switch s.Type {
+	case TypeCounter:
+		a.counters[key] += s.Value / s.SampleRate
+	case TypeGauge:
+		if s.Relative {
+			a.gauges[key] += s.Value
+		} else {
+			a.gauges[key] = s.Value
+		}
+		a.updated[key] = struct{}{}
+		a.idle[key] = 0
+	case TypeTimer, TypeHistogram:
+		t, ok := a.timers[key]
+		if !ok {
+			t = &timer{}
+			a.timers[key] = t
+		}
+		t.values = append(t.values, s.Value)
+		t.count += 1 / s.SampleRate
+	case TypeSet:
+		set, ok := a.sets[key]
+		if !ok {
+			set = make(map[string]struct{})
+			a.sets[key] = set
+		}
+		set[s.Raw] = struct{}{}
+	}
+}
+
+// Flush
+// converts samples aggregated since previous flush into metrics and starts new window.
+// Gauges keep their values between windows to support relative updates, but only updated ones are reported.
+// Gauges not updated for gaugeIdleFlushes windows are forgotten, so relative updates of them start from zero
+func (a *Aggregator) Flush() []model.Metrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var metrics []model.Metrics
+
+	for key, value := range a.counters {
+		delta := int64(math.Round(value))
+		metrics = append(metrics, model.Metrics{ID: key, MType: model.MetricTypeCounter, Delta: &delta})
+	}
+
+	for key := range a.updated {
+		value := a.gauges[key]
+		metrics = append(metrics, model.Metrics{ID: key, MType: model.MetricTypeGauge, Value: &value})
+	}
+
+	for key, t := range a.timers {
+		metrics = append(metrics, t.metrics(key)...)
+	}
+
+	for key, set := range a.sets {
+		value := float64(len(set))
+		metrics = append(metrics, model.Metrics{ID: key, MType: model.MetricTypeGauge, Value: &value})
+	}
+
+	for key := range a.gauges {
+		if _, ok := a.updated[key]; ok {
+			continue
+		}
+		a.idle[key]++
+		if a.idle[key] >= gaugeIdleFlushes {
+			delete(a.gauges, key)
+			delete(a.idle, key)
+		}
+	}
+
+	a.counters = make(map[string]float64)
+	a.updated = make(map[string]struct{})
+	a.timers = make(map[string]*timer)
+	a.sets = make(map[string]map[string]struct{})
+
+	return metrics
+}
+
+// metrics
+// returns count, min, max, mean and quantiles of timer values
+func (t *timer) metrics(key string) []model.Metrics {
+	sort.Float64s(t.values)
+
+	var sum float64
+	for _, v := range t.values {
+		sum += v
+	}
+
+	count := int64(math.Round(t.count))
+	minValue := t.values[0]
+	maxValue := t.values[len(t.values)-1]
+	mean := sum / float64(len(t.values))
+
+	metrics := []model.Metrics{
+		{ID: key + "_count", MType: model.MetricTypeCounter, Delta: &count},
+		{ID: key + "_min", MType: model.MetricTypeGauge, Value: &minValue},
+		{ID: key + "_max", MType: model.MetricTypeGauge, Value: &maxValue},
+		{ID: key + "_mean", MType: model.MetricTypeGauge, Value: &mean},
+	}
+
+	for _, quantile := range timerQuantiles {
+		idx := int(math.Ceil(quantile.q*float64(len(t.values)))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		value := t.values[idx]
+		metrics = append(metrics, model.Metrics{ID: key + quantile.suffix, MType: model.MetricTypeGauge, Value: &value})
+	}
+
+	return metrics
+}
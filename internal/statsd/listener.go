@@ -0,0 +1,85 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/logger"
+)
+
+const maxPacketSize = 65535
+
+// ListenUDP
+// receives statsd packets on UDP address until context is done
+func (a *Aggregator) ListenUDP(ctx context.Context, address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+
+	logger.Log.Info("StatsD listener started", zap.String("address", conn.LocalAddr().String()))
+
+	return a.serve(ctx, conn)
+}
+
+// ListenUnixgram
+// receives statsd packets on unix datagram socket until context is done, stale socket file is removed
+func (a *Aggregator) ListenUnixgram(ctx context.Context, path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	logger.Log.Info("StatsD listener started", zap.String("socket", path))
+
+	return a.serve(ctx, conn)
+}
+
+func (a *Aggregator) serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		a.AddPacket(buf[:n])
+	}
+}
+
+// AddPacket
+// parses newline separated statsd lines and aggregates valid ones
+func (a *Aggregator) AddPacket(packet []byte) {
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		sample, err := Parse(line)
+		if err != nil {
+			logger.Log.Debug("invalid statsd line", zap.String("line", line), zap.Error(err))
+			continue
+		}
+
+		a.Add(sample)
+	}
+}
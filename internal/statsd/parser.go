@@ -0,0 +1,115 @@
+// Package statsd implements StatsD/DogStatsD compatible listener which aggregates
+// received samples and converts them into metrics
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TypeCounter   = "c"
+	TypeGauge     = "g"
+	TypeTimer     = "ms"
+	TypeHistogram = "h"
+	TypeSet       = "s"
+)
+
+var (
+	ErrInvalidLine       = errors.New("invalid statsd line")
+	ErrInvalidType       = errors.New("invalid statsd metric type")
+	ErrInvalidValue      = errors.New("invalid statsd metric value")
+	ErrInvalidSampleRate = errors.New("invalid statsd sample rate")
+)
+
+// Sample is a single parsed StatsD line
+type Sample struct {
+	Name string
+	Type string
+	// Value holds numeric value for counters, gauges, timers and histograms
+	Value float64
+	// Raw holds unparsed value, used by sets
+	Raw string
+	// Relative is set for gauges sent with explicit sign, e.g. "+5" or "-3"
+	Relative   bool
+	SampleRate float64
+	Tags       []string
+}
+
+// Parse
+// parses line in format <name>:<value>|<type>[|@<sample rate>][|#<tag>,<tag:value>]
+func Parse(line string) (Sample, error) {
+	sample := Sample{SampleRate: 1}
+
+	pipe := strings.Index(line, "|")
+	if pipe < 0 {
+		return sample, ErrInvalidLine
+	}
+	// value is separated from name by the last ':' before first pipe
+	nameEnd := strings.LastIndex(line[:pipe], ":")
+	if nameEnd <= 0 {
+		return sample, ErrInvalidLine
+	}
+
+	sample.Name = line[:nameEnd]
+	sample.Raw = line[nameEnd+1 : pipe]
+
+	parts := strings.Split(line[pipe+1:], "|")
+	sample.Type = parts[0]
+	switch sample.Type {
+	case TypeCounter, TypeGauge, TypeTimer, TypeHistogram, TypeSet:
+	default:
+		return sample, fmt.Errorf("%w: %s", ErrInvalidType, sample.Type)
+	}
+
+	for _, part := range parts[1:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return sample, fmt.Errorf("%w: %s", ErrInvalidSampleRate, part[1:])
+			}
+			sample.SampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			sample.Tags = strings.Split(part[1:], ",")
+		}
+	}
+
+	if sample.Type == TypeSet {
+		if sample.Raw == "" {
+			return sample, ErrInvalidValue
+		}
+		return sample, nil
+	}
+
+	value, err := strconv.ParseFloat(sample.Raw, 64)
+	if err != nil {
+		return sample, fmt.Errorf("%w: %s", ErrInvalidValue, sample.Raw)
+	}
+	sample.Value = value
+	sample.Relative = sample.Type == TypeGauge && (sample.Raw[0] == '+' || sample.Raw[0] == '-')
+
+	return sample, nil
+}
+
+// Key
+// returns metric ID of the sample, tags are appended in graphite tagged series format: name;tag1=value1;tag2
+func (s Sample) Key() string {
+	if len(s.Tags) == 0 {
+		return s.Name
+	}
+
+	tags := make([]string, 0, len(s.Tags))
+	for _, tag := range s.Tags {
+		if tag == "" {
+			continue
+		}
+		tags = append(tags, strings.Replace(tag, ":", "=", 1))
+	}
+	sort.Strings(tags)
+
+	return strings.Join(append([]string{s.Name}, tags...), ";")
+}
@@ -0,0 +1,145 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Sample
+		wantErr bool
+	}{
+		{
+			name: "counter",
+			line: "requests:1|c",
+			want: Sample{Name: "requests", Type: TypeCounter, Value: 1, Raw: "1", SampleRate: 1},
+		},
+		{
+			name: "counter with sample rate and tags",
+			line: "requests:2|c|@0.5|#env:prod,api",
+			want: Sample{Name: "requests", Type: TypeCounter, Value: 2, Raw: "2", SampleRate: 0.5, Tags: []string{"env:prod", "api"}},
+		},
+		{
+			name: "relative gauge",
+			line: "queue:-3|g",
+			want: Sample{Name: "queue", Type: TypeGauge, Value: -3, Raw: "-3", Relative: true, SampleRate: 1},
+		},
+		{
+			name: "timer",
+			line: "latency:12.5|ms",
+			want: Sample{Name: "latency", Type: TypeTimer, Value: 12.5, Raw: "12.5", SampleRate: 1},
+		},
+		{
+			name: "set",
+			line: "users:alice|s",
+			want: Sample{Name: "users", Type: TypeSet, Raw: "alice", SampleRate: 1},
+		},
+		{name: "no type", line: "requests:1", wantErr: true},
+		{name: "unknown type", line: "requests:1|x", wantErr: true},
+		{name: "bad value", line: "requests:abc|c", wantErr: true},
+		{name: "bad sample rate", line: "requests:1|c|@2", wantErr: true},
+		{name: "no name", line: ":1|c", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSample_Key(t *testing.T) {
+	sample := Sample{Name: "requests", Tags: []string{"method:get", "env:prod", "api"}}
+	assert.Equal(t, "requests;api;env=prod;method=get", sample.Key())
+}
+
+func TestAggregator_Flush(t *testing.T) {
+	a := NewAggregator()
+	a.AddPacket([]byte("requests:1|c\nrequests:1|c|@0.5\nqueue:10|g\nqueue:+5|g\nusers:alice|s\nusers:bob|s\nusers:alice|s\nbroken line\n"))
+	for _, v := range []string{"1", "2", "3", "4"} {
+		a.AddPacket([]byte("latency:" + v + "|ms"))
+	}
+
+	got := toMap(a.Flush())
+
+	assert.Equal(t, int64(3), *got["requests"].Delta)
+	assert.Equal(t, float64(15), *got["queue"].Value)
+	assert.Equal(t, float64(2), *got["users"].Value)
+	assert.Equal(t, int64(4), *got["latency_count"].Delta)
+	assert.Equal(t, float64(1), *got["latency_min"].Value)
+	assert.Equal(t, float64(4), *got["latency_max"].Value)
+	assert.Equal(t, 2.5, *got["latency_mean"].Value)
+	assert.Equal(t, float64(2), *got["latency_p50"].Value)
+
+	a.AddPacket([]byte("queue:-1|g"))
+	got = toMap(a.Flush())
+	assert.Len(t, got, 1)
+	assert.Equal(t, float64(14), *got["queue"].Value)
+
+	// idle gauge is forgotten, relative update starts from zero
+	for i := 0; i < gaugeIdleFlushes; i++ {
+		assert.Empty(t, a.Flush())
+	}
+	a.AddPacket([]byte("queue:+2|g"))
+	got = toMap(a.Flush())
+	assert.Equal(t, float64(2), *got["queue"].Value)
+}
+
+func TestAggregator_ListenUDP(t *testing.T) {
+	addr := freeUDPAddress(t)
+	a := NewAggregator()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- a.ListenUDP(ctx, addr)
+	}()
+
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Eventually(t, func() bool {
+		_, err := conn.Write([]byte("requests:1|c"))
+		require.NoError(t, err)
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.counters["requests"] > 0
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func freeUDPAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
+
+func toMap(metrics []model.Metrics) map[string]model.Metrics {
+	result := make(map[string]model.Metrics)
+	for _, m := range metrics {
+		result[m.ID] = m
+	}
+
+	return result
+}
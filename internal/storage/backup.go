@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/derpartizanen/metrics/internal/compressor"
+	"github.com/derpartizanen/metrics/internal/logger"
+	"github.com/derpartizanen/metrics/internal/snapshot"
+)
+
+// backupHeader starts the first line of backup file, followed by checksum and compression of payload,
+// files without header are treated as legacy plain json backups
+const backupHeader = "metrics-backup"
+
+// backupTimeFormat is a suffix of backup file name, it sorts in chronological order
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+var (
+	ErrBackupChecksum = errors.New("backup checksum mismatch")
+	ErrInvalidBackup  = errors.New("invalid backup header")
+	ErrNoBackup       = fmt.Errorf("no valid backup found: %w", os.ErrNotExist)
+	ErrNoStoragePath  = errors.New("storage path is not set")
+)
+
+// writeBackupFile
+// atomically writes data as a new timestamped backup next to storage path and removes
+// backups older than the last settings.BackupKeep ones. Storage path itself is replaced
+// with a copy of the newest backup, so it stays up to date for tools reading it
+func (s *Storage) writeBackupFile(data []byte) error {
+	if s.settings.StoragePath == "" {
+		return ErrNoStoragePath
+	}
+
+	content, err := encodeBackup(data, s.settings.BackupCompress)
+	if err != nil {
+		return err
+	}
+
+	path := s.settings.StoragePath + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := writeFileAtomic(path, content); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.settings.StoragePath, content); err != nil {
+		return err
+	}
+
+	s.rotateBackups()
+
+	return nil
+}
+
+// readSnapshot
+// returns the newest valid backup, damaged backups are skipped.
+// Copy of the newest backup or legacy backup stored right at storage path is the last resort
+func (s *Storage) readSnapshot() (*snapshot.Snapshot, error) {
+	candidates := backupFiles(s.settings.StoragePath)
+	candidates = append(candidates, s.settings.StoragePath)
+
+	for _, path := range candidates {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				logger.Log.Warn("Read backup failed", zap.String("path", path), zap.Error(err))
+			}
+			continue
+		}
+
+		data, err := decodeBackup(content)
+		if err != nil {
+			logger.Log.Warn("Skip damaged backup", zap.String("path", path), zap.Error(err))
+			continue
+		}
+
+		snap, err := snapshot.Decode(data)
+		if err != nil {
+			logger.Log.Warn("Skip damaged backup", zap.String("path", path), zap.Error(err))
+			continue
+		}
+
+		logger.Log.Info("Restoring metrics from backup", zap.String("path", path))
+		return snap, nil
+	}
+
+	return nil, ErrNoBackup
+}
+
+func (s *Storage) rotateBackups() {
+	keep := s.settings.BackupKeep
+	if keep < 1 {
+		keep = 1
+	}
+
+	files := backupFiles(s.settings.StoragePath)
+	if len(files) <= keep {
+		return
+	}
+
+	for _, path := range files[keep:] {
+		if err := os.Remove(path); err != nil {
+			logger.Log.Warn("Remove old backup failed", zap.String("path", path), zap.Error(err))
+		}
+	}
+}
+
+// backupFiles
+// returns timestamped backups of storage path, the newest first
+func backupFiles(storagePath string) []string {
+	matches, err := filepath.Glob(storagePath + ".*")
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	for _, path := range matches {
+		suffix := strings.TrimPrefix(path, storagePath+".")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			files = append(files, path)
+		}
+	}
+
+	slices.Sort(files)
+	slices.Reverse(files)
+
+	return files
+}
+
+func encodeBackup(data []byte, compress bool) ([]byte, error) {
+	sum := sha256.Sum256(data)
+
+	compression := "none"
+	payload := data
+	if compress {
+		var err error
+		payload, err = compressor.Compress(data)
+		if err != nil {
+			return nil, err
+		}
+		compression = "gzip"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s sha256=%s compression=%s\n", backupHeader, hex.EncodeToString(sum[:]), compression)
+	buf.Write(payload)
+
+	return buf.Bytes(), nil
+}
+
+func decodeBackup(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, []byte(backupHeader+" ")) {
+		return content, nil
+	}
+
+	header, payload, ok := bytes.Cut(content, []byte("\n"))
+	if !ok {
+		return nil, ErrInvalidBackup
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(string(header))[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		fields[key] = value
+	}
+
+	data := payload
+	switch fields["compression"] {
+	case "gzip":
+		var err error
+		data, err = compressor.Decompress(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBackupChecksum, err)
+		}
+	case "none", "":
+	default:
+		return nil, fmt.Errorf("%w: unknown compression '%s'", ErrInvalidBackup, fields["compression"])
+	}
+
+	sum := sha256.Sum256(data)
+	if fields["sha256"] != hex.EncodeToString(sum[:]) {
+		return nil, ErrBackupChecksum
+	}
+
+	return data, nil
+}
+
+// writeFileAtomic
+// writes content to temporary file in the same directory, syncs it and renames to path,
+// so path contains either previous or new content even after crash
+func writeFileAtomic(path string, content []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// rename is durable once directory entry is synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
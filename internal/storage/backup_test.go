@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+func TestStorage_BackupRotation(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		cfg := config.ServerConfig{
+			StoragePath:    filepath.Join(t.TempDir(), "metrics.json"),
+			StoreInterval:  300,
+			BackupKeep:     2,
+			BackupCompress: compress,
+		}
+		store := New(context.Background(), cfg)
+
+		for _, value := range []string{"1", "2", "3"} {
+			require.NoError(t, store.Save(context.Background(), model.MetricTypeGauge, "Alloc", value))
+			require.NoError(t, store.Backup(context.Background()))
+		}
+
+		files := backupFiles(cfg.StoragePath)
+		require.Len(t, files, 2, "only the last backups should be kept")
+
+		newest, err := os.ReadFile(files[0])
+		require.NoError(t, err)
+		latest, err := os.ReadFile(cfg.StoragePath)
+		require.NoError(t, err)
+		assert.Equal(t, newest, latest, "storage path should hold a copy of the newest backup")
+
+		restored := New(context.Background(), config.ServerConfig{StoragePath: cfg.StoragePath, Restore: true})
+		value, err := restored.Get(context.Background(), model.MetricTypeGauge, "Alloc")
+		require.NoError(t, err)
+		assert.Equal(t, float64(3), value)
+	}
+}
+
+func TestStorage_RestoreFallback(t *testing.T) {
+	cfg := config.ServerConfig{StoragePath: filepath.Join(t.TempDir(), "metrics.json"), StoreInterval: 300, BackupKeep: 3}
+	store := New(context.Background(), cfg)
+
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeGauge, "Alloc", "1"))
+	require.NoError(t, store.Backup(context.Background()))
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeGauge, "Alloc", "2"))
+	require.NoError(t, store.Backup(context.Background()))
+
+	// damage the newest backup
+	files := backupFiles(cfg.StoragePath)
+	require.Len(t, files, 2)
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	content[len(content)-3] = 'X'
+	require.NoError(t, os.WriteFile(files[0], content, 0o644))
+
+	restored := New(context.Background(), config.ServerConfig{StoragePath: cfg.StoragePath, Restore: true})
+	value, err := restored.Get(context.Background(), model.MetricTypeGauge, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), value)
+}
+
+func TestStorage_RestoreLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"id":"PollCount","type":"counter","delta":4}]`), 0o644))
+
+	store := New(context.Background(), config.ServerConfig{StoragePath: path, Restore: true})
+	value, err := store.Get(context.Background(), model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), value)
+}
+
+func TestDecodeBackup(t *testing.T) {
+	content, err := encodeBackup([]byte("[]"), true)
+	require.NoError(t, err)
+
+	data, err := decodeBackup(content)
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+
+	_, err = decodeBackup([]byte("metrics-backup sha256=00 compression=none\n[]"))
+	assert.ErrorIs(t, err, ErrBackupChecksum)
+}
+
+func TestStorage_RestoreSetsCounters(t *testing.T) {
+	cfg := config.ServerConfig{StoragePath: filepath.Join(t.TempDir(), "metrics.json"), StoreInterval: 300, BuildVersion: "v1.2.3"}
+	store := New(context.Background(), cfg)
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "5"))
+	require.NoError(t, store.Backup(context.Background()))
+
+	snap, err := store.readSnapshot()
+	require.NoError(t, err)
+	assert.Equal(t, "v1.2.3", snap.ServerVersion)
+	assert.Equal(t, 1, snap.Count)
+	assert.False(t, snap.Metrics[0].UpdatedAt.IsZero())
+
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "3"))
+	require.NoError(t, store.Restore(context.Background()))
+
+	value, err := store.Get(context.Background(), model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value, "restore should set counter instead of adding to it")
+}
@@ -1,61 +1,132 @@
 package storage
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"strconv"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/history"
 	"github.com/derpartizanen/metrics/internal/interfaces"
 	"github.com/derpartizanen/metrics/internal/logger"
 	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/internal/repository/filestorage"
 	"github.com/derpartizanen/metrics/internal/repository/memstorage"
 	"github.com/derpartizanen/metrics/internal/repository/postgres"
+	"github.com/derpartizanen/metrics/internal/snapshot"
+	"github.com/derpartizanen/metrics/internal/wal"
 )
 
 var (
 	ErrInvalidGaugeMetricValue   = errors.New("invalid gauge metric value")
 	ErrInvalidCounterMetricValue = errors.New("invalid counter metric value")
 	ErrInvalidMetricType         = errors.New("invalid metric type")
+	ErrInvalidPattern            = errors.New("invalid metric name pattern")
 )
 
+// maxInProcessRawRetention caps retention of raw history samples kept in server memory,
+// which are not trimmed by database as in postgres engine
+const maxInProcessRawRetention = 24 * time.Hour
+
 type Storage struct {
 	repository interfaces.Repository
 	settings   Settings
+	wal        *wal.WAL
+	// history is kept by server itself in memory and file engines, nil for postgres engine
+	history *history.Store
+	// mu is held for reading by updates recorded in write-ahead log and for writing by snapshot,
+	// so snapshot and truncated log never miss or repeat an update
+	mu sync.RWMutex
 }
 
 type Settings struct {
-	StoragePath   string
-	StoreInterval int64
+	StoragePath    string
+	StoreInterval  int64
+	BackupKeep     int
+	BackupCompress bool
+	ServerVersion  string
+	// QueryTimeout limits time of every repository call, zero means no limit
+	QueryTimeout time.Duration
+	// InMemory is set when metrics are kept in memory and persisted to backup files
+	InMemory bool
+	// Resolutions of metric history from the finest to the coarsest
+	Resolutions []history.Resolution
+	// SeriesTTL is a time after the last update when metric is expired, zero means metrics never expire
+	SeriesTTL time.Duration
 }
 
 // New
 // returns new storage with repository depending on config settings
 func New(ctx context.Context, cfg config.ServerConfig) *Storage {
 	settings := Settings{
-		StoragePath:   cfg.StoragePath,
-		StoreInterval: cfg.StoreInterval,
+		StoragePath:    cfg.StoragePath,
+		StoreInterval:  cfg.StoreInterval,
+		BackupKeep:     cfg.BackupKeep,
+		BackupCompress: cfg.BackupCompress,
+		ServerVersion:  cfg.BuildVersion,
+		InMemory:       cfg.Engine() == config.StorageEngineMemory,
+		QueryTimeout:   time.Duration(cfg.QueryTimeout) * time.Millisecond,
+		SeriesTTL:      time.Duration(cfg.SeriesTTL) * time.Second,
+		Resolutions: history.Resolutions(
+			time.Duration(cfg.HistoryRetention)*24*time.Hour,
+			time.Duration(cfg.RollupMinRetention)*24*time.Hour,
+			time.Duration(cfg.RollupHourRetention)*24*time.Hour,
+		),
 	}
 
-	if cfg.DatabaseDSN != "" {
-		repo, err := postgres.New(ctx, cfg.DatabaseDSN)
+	switch cfg.Engine() {
+	case config.StorageEnginePostgres:
+		repo, err := postgres.New(ctx, cfg.DatabaseDSN, postgres.PoolSettings{
+			MaxConns:        int32(cfg.DBMaxConns),
+			MinConns:        int32(cfg.DBMinConns),
+			MaxConnLifetime: time.Duration(cfg.DBMaxConnLifetime) * time.Second,
+		}, postgres.HistorySettings{
+			Partition:       cfg.HistoryPartition,
+			Retention:       settings.Resolutions[0].Retention,
+			MinuteRetention: settings.Resolutions[1].Retention,
+			HourRetention:   settings.Resolutions[2].Retention,
+		})
 		if err != nil {
 			logger.Log.Fatal("Init database storage error", zap.Error(err))
 		}
 
 		return &Storage{repository: repo, settings: settings}
+	case config.StorageEngineFile:
+		repo, err := filestorage.New(cfg.StorageDBPath)
+		if err != nil {
+			logger.Log.Fatal("Init file storage error", zap.Error(err))
+		}
+
+		settings.Resolutions = capRawRetention(settings.Resolutions)
+		store := history.NewStore(settings.Resolutions)
+
+		return &Storage{repository: repo.WithHistory(store), settings: settings, history: store}
+	}
+
+	settings.Resolutions = capRawRetention(settings.Resolutions)
+	store := history.NewStore(settings.Resolutions)
+	repo := memstorage.New().WithHistory(store)
+	storage := &Storage{repository: repo, settings: settings, history: store}
+	if cfg.WALPath != "" {
+		err := storage.openWAL(ctx, cfg.WALPath, cfg.WALSync, cfg.Restore)
+		if err != nil {
+			logger.Log.Fatal("Init write-ahead log error", zap.Error(err))
+		}
+
+		return storage
 	}
 
-	repo := memstorage.New()
-	storage := &Storage{repository: repo, settings: settings}
 	if cfg.Restore {
-		err := storage.Restore()
+		err := storage.Restore(ctx)
 		if err != nil {
 			logger.Log.Error("Restore failed", zap.Error(err))
 		}
@@ -64,63 +135,264 @@ func New(ctx context.Context, cfg config.ServerConfig) *Storage {
 	return storage
 }
 
-// Restore
-// retrieve storage data from file
-func (s *Storage) Restore() error {
-	logger.Log.Info("Restoring metrics from backup file")
+// capRawRetention
+// limits retention of raw samples kept in memory, unlimited retention included
+func capRawRetention(resolutions []history.Resolution) []history.Resolution {
+	for i, r := range resolutions {
+		if r.Name == history.ResolutionRaw && (r.Retention <= 0 || r.Retention > maxInProcessRawRetention) {
+			logger.Log.Warn("Raw history retention is capped for history kept in memory",
+				zap.Duration("retention", r.Retention), zap.Duration("max", maxInProcessRawRetention))
+			resolutions[i].Retention = maxInProcessRawRetention
+		}
+	}
 
-	data, err := os.ReadFile(s.settings.StoragePath)
+	return resolutions
+}
+
+// openWAL
+// opens write-ahead log, if it is not empty storage is restored from snapshot and log records
+// regardless of restore setting. Records already saved in the snapshot are skipped
+func (s *Storage) openWAL(ctx context.Context, path string, policy string, restore bool) error {
+	exists := wal.Exists(path)
+
+	w, err := wal.Open(path, policy)
 	if err != nil {
 		return err
 	}
+	s.wal = w
+
+	snap, err := s.readSnapshot()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+
+	var saved uint64
+	if snap != nil {
+		// new records are numbered after the saved ones even if log is empty,
+		// otherwise they would be skipped on the next replay
+		saved = snap.WALSequence
+		w.Advance(saved)
+	}
+
+	if !exists {
+		if restore {
+			if snap == nil {
+				logger.Log.Error("Restore failed", zap.Error(err))
+			} else if err := s.restoreSnapshot(ctx, snap); err != nil {
+				logger.Log.Error("Restore failed", zap.Error(err))
+			}
+		}
+		return nil
+	}
+
+	if snap != nil {
+		if err := s.restoreSnapshot(ctx, snap); err != nil {
+			return fmt.Errorf("restore snapshot: %w", err)
+		}
+	}
+
+	replayed, skipped := 0, 0
+	err = w.Replay(func(seq uint64, metric model.Metrics) error {
+		// log was not truncated after the snapshot was written, e.g. because of crash
+		if seq != 0 && seq <= saved {
+			skipped++
+			return nil
+		}
+		replayed++
+		return s.repository.SetAllMetrics(ctx, []model.Metrics{metric})
+	})
+	if err != nil {
+		return fmt.Errorf("replay write-ahead log: %w", err)
+	}
+	logger.Log.Info(fmt.Sprintf("Replayed %d write-ahead log records", replayed), zap.Int("skipped", skipped))
+
+	return nil
+}
+
+// queryContext
+// returns context limited by configured query timeout
+func (s *Storage) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.settings.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, s.settings.QueryTimeout)
+}
+
+// Close
+// flushes and closes write-ahead log, releases database connections or storage file
+func (s *Storage) Close() error {
+	switch closer := s.repository.(type) {
+	case interface{ Close() }:
+		closer.Close()
+	case interface{ Close() error }:
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+
+	if s.wal == nil {
+		return nil
+	}
+
+	return s.wal.Close()
+}
+
+// apply
+// records metrics in write-ahead log if it is enabled and runs repository update
+func (s *Storage) apply(metrics []model.Metrics, update func() error) error {
+	if s.wal == nil {
+		return update()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.wal.Append(metrics...); err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+
+	return update()
+}
 
-	metrics := make([]model.Metrics, 0)
-	if err := json.Unmarshal(data, &metrics); err != nil {
+// Restore
+// retrieve storage data from the newest valid backup file, stored counter values replace current ones
+func (s *Storage) Restore(ctx context.Context) error {
+	logger.Log.Info("Restoring metrics from backup file")
+
+	snap, err := s.readSnapshot()
+	if err != nil {
 		return err
 	}
 
-	logger.Log.Info(fmt.Sprintf("Loaded %d metrics", len(metrics)))
+	return s.restoreSnapshot(ctx, snap)
+}
+
+// restoreSnapshot
+// replaces storage data with snapshot records
+func (s *Storage) restoreSnapshot(ctx context.Context, snap *snapshot.Snapshot) error {
+	if snap.Newer() {
+		logger.Log.Warn("Backup is written in newer format, unknown fields are ignored",
+			zap.Int("version", snap.Version), zap.String("server_version", snap.ServerVersion))
+	}
+	logger.Log.Info(fmt.Sprintf("Loaded %d metrics", len(snap.Metrics)), zap.Time("created_at", snap.CreatedAt))
 
-	return s.SetAllMetrics(metrics)
+	return s.repository.RestoreRecords(ctx, snap.Metrics)
 }
 
 // Backup
-// save storage data to file
-func (s *Storage) Backup() error {
+// save storage data to file, write-ahead log is truncated as its records are in the file now
+func (s *Storage) Backup(ctx context.Context) error {
 	logger.Log.Debug("Backing up metrics to file")
 
-	f, err := os.Create(s.settings.StoragePath)
+	if s.wal != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+
+	snap, err := s.Snapshot(ctx)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if s.wal != nil {
+		// all appended records are applied as updates wait for the lock
+		snap.WALSequence = s.wal.Sequence()
+	}
 
-	writer := bufio.NewWriter(f)
-	encoder := json.NewEncoder(writer)
-	encoder.SetIndent("", "    ")
+	data, err := snap.Encode()
+	if err != nil {
+		return err
+	}
 
-	metrics, err := s.GetAllMetrics()
+	if err := s.writeBackupFile(data); err != nil {
+		return err
+	}
+
+	if s.wal != nil {
+		return s.wal.Truncate()
+	}
+
+	return nil
+}
+
+// Export
+// writes snapshot of all metrics in json format
+func (s *Storage) Export(ctx context.Context, w io.Writer) error {
+	snap, err := s.Snapshot(ctx)
 	if err != nil {
 		return err
 	}
 
-	if err := encoder.Encode(metrics); err != nil {
+	data, err := snap.Encode()
+	if err != nil {
 		return err
 	}
 
-	return writer.Flush()
+	_, err = w.Write(data)
+
+	return err
+}
+
+// Import
+// restores metrics from exported snapshot or backup file and returns their count.
+// Imported values replace current ones, other metrics are kept. In memory mode backup is saved at once
+func (s *Storage) Import(ctx context.Context, data []byte) (int, error) {
+	data, err := decodeBackup(data)
+	if err != nil {
+		return 0, err
+	}
+
+	snap, err := snapshot.Decode(data)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	err = s.repository.RestoreRecords(ctx, snap.Metrics)
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	if s.settings.InMemory && s.settings.StoragePath != "" {
+		if err := s.Backup(ctx); err != nil {
+			return 0, fmt.Errorf("backup imported metrics: %w", err)
+		}
+	}
+
+	return len(snap.Metrics), nil
+}
+
+// Snapshot
+// returns all metrics with time of their last update in versioned envelope
+func (s *Storage) Snapshot(ctx context.Context) (*snapshot.Snapshot, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	records, err := s.repository.GetAllRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot.New(records, s.settings.ServerVersion), nil
 }
 
 // Save
 // set metric into storage
-func (s *Storage) Save(metricType string, metricName string, value string) error {
+func (s *Storage) Save(ctx context.Context, metricType string, metricName string, value string) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
 	if metricType == model.MetricTypeCounter {
 		intValue, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
 			return ErrInvalidCounterMetricValue
 		}
 
-		return s.repository.UpdateCounterMetric(metricName, intValue)
+		metric := model.Metrics{ID: metricName, MType: metricType, Delta: &intValue}
+		return s.apply([]model.Metrics{metric}, func() error {
+			return s.repository.UpdateCounterMetric(ctx, metricName, intValue)
+		})
 	}
 
 	if metricType == model.MetricTypeGauge {
@@ -129,24 +401,40 @@ func (s *Storage) Save(metricType string, metricName string, value string) error
 			return ErrInvalidGaugeMetricValue
 		}
 
-		return s.repository.UpdateGaugeMetric(metricName, floatValue)
+		metric := model.Metrics{ID: metricName, MType: metricType, Value: &floatValue}
+		return s.apply([]model.Metrics{metric}, func() error {
+			return s.repository.UpdateGaugeMetric(ctx, metricName, floatValue)
+		})
 	}
 
 	return ErrInvalidMetricType
 }
 
 // SaveMetric
-// set metric into storage
-func (s *Storage) SaveMetric(metric model.Metrics) error {
+// set metric into storage, counter with reset flag is replaced by metric delta
+func (s *Storage) SaveMetric(ctx context.Context, metric model.Metrics) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
 	var err error
 
 	if metric.MType == model.MetricTypeCounter {
 		if metric.Delta == nil {
 			return ErrInvalidCounterMetricValue
 		}
-		err = s.repository.UpdateCounterMetric(metric.ID, *metric.Delta)
+		err = s.apply([]model.Metrics{metric}, func() error {
+			if metric.Reset {
+				return s.repository.ResetCounterMetric(ctx, metric.ID, *metric.Delta)
+			}
+			return s.repository.UpdateCounterMetric(ctx, metric.ID, *metric.Delta)
+		})
 	} else if metric.MType == model.MetricTypeGauge {
-		err = s.repository.UpdateGaugeMetric(metric.ID, *metric.Value)
+		if metric.Value == nil {
+			return ErrInvalidGaugeMetricValue
+		}
+		err = s.apply([]model.Metrics{metric}, func() error {
+			return s.repository.UpdateGaugeMetric(ctx, metric.ID, *metric.Value)
+		})
 	} else {
 		err = ErrInvalidMetricType
 	}
@@ -155,9 +443,9 @@ func (s *Storage) SaveMetric(metric model.Metrics) error {
 		return err
 	}
 
-	if s.settings.StoreInterval == 0 {
+	if s.settings.InMemory && s.settings.StoreInterval == 0 && s.wal == nil && s.settings.StoragePath != "" {
 		logger.Log.Debug("Sync metrics save")
-		err = s.Backup()
+		err = s.Backup(ctx)
 		if err != nil {
 			logger.Log.Error("Sync save failed", zap.Error(err))
 		}
@@ -167,63 +455,282 @@ func (s *Storage) SaveMetric(metric model.Metrics) error {
 }
 
 // Get
-// retrieve metric value from storage
-func (s *Storage) Get(metricType string, metricName string) (interface{}, error) {
-	if metricType == model.MetricTypeGauge {
-		value, err := s.repository.GetGaugeMetric(metricName)
-
-		return value, err
+// retrieve metric value from storage, metric expired by series TTL is not found
+func (s *Storage) Get(ctx context.Context, metricType string, metricName string) (interface{}, error) {
+	if metricType != model.MetricTypeGauge && metricType != model.MetricTypeCounter {
+		return nil, ErrInvalidMetricType
 	}
 
-	if metricType == model.MetricTypeCounter {
-		value, err := s.repository.GetCounterMetric(metricName)
+	metric, err := s.getLive(ctx, metricType, metricName)
+	if err != nil {
+		return nil, err
+	}
 
-		return value, err
+	if metricType == model.MetricTypeGauge {
+		return *metric.Value, nil
 	}
 
-	return nil, ErrInvalidMetricType
+	return *metric.Delta, nil
 }
 
 // GetMetric
-// retrieve metric from storage
-func (s *Storage) GetMetric(metric *model.Metrics) error {
-	if metric.MType == model.MetricTypeGauge {
-		value, err := s.repository.GetGaugeMetric(metric.ID)
-		if err != nil {
-			return err
-		}
-		metric.Value = &value
+// retrieve metric from storage, metric expired by series TTL is not found
+func (s *Storage) GetMetric(ctx context.Context, metric *model.Metrics) error {
+	if metric.MType != model.MetricTypeGauge && metric.MType != model.MetricTypeCounter {
+		return nil
 	}
 
-	if metric.MType == model.MetricTypeCounter {
-		value, err := s.repository.GetCounterMetric(metric.ID)
-		if err != nil {
-			return err
-		}
-		metric.Delta = &value
+	found, err := s.getLive(ctx, metric.MType, metric.ID)
+	if err != nil {
+		return err
 	}
+	metric.Value, metric.Delta = found.Value, found.Delta
 
 	return nil
 }
 
+// getLive
+// retrieve metric by type and name, metrics not updated for series TTL are hidden until they are deleted
+// by ExpireStale, as in GetAllMetrics
+func (s *Storage) getLive(ctx context.Context, metricType string, metricName string) (model.Metrics, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	record, err := s.repository.GetRecord(ctx, metricType, metricName)
+	if err != nil {
+		return model.Metrics{}, err
+	}
+
+	if s.settings.SeriesTTL > 0 && record.UpdatedAt.Before(time.Now().Add(-s.settings.SeriesTTL)) {
+		return model.Metrics{}, memstorage.ErrNotFound
+	}
+
+	return record.Metrics, nil
+}
+
 // GetAllMetrics
 // retrieve all metrics from storage
-func (s *Storage) GetAllMetrics() ([]model.Metrics, error) {
-	metrics, err := s.repository.GetAllMetrics()
+func (s *Storage) GetAllMetrics(ctx context.Context) ([]model.Metrics, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	if s.settings.SeriesTTL <= 0 {
+		metrics, err := s.repository.GetAllMetrics(ctx)
+		if err != nil {
+			logger.Log.Error("Get metrics error")
+		}
+
+		return metrics, nil
+	}
+
+	// expired metrics are hidden until they are deleted by ExpireStale
+	records, err := s.repository.GetAllRecords(ctx)
 	if err != nil {
 		logger.Log.Error("Get metrics error")
 	}
 
+	var metrics []model.Metrics
+	cutoff := time.Now().Add(-s.settings.SeriesTTL)
+	for _, record := range records {
+		if !record.UpdatedAt.Before(cutoff) {
+			metrics = append(metrics, record.Metrics)
+		}
+	}
+
 	return metrics, nil
 }
 
 // SetAllMetrics
 // set slice of metrics to storage
-func (s *Storage) SetAllMetrics(metrics []model.Metrics) error {
-	return s.repository.SetAllMetrics(metrics)
+func (s *Storage) SetAllMetrics(ctx context.Context, metrics []model.Metrics) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.apply(metrics, func() error {
+		return s.repository.SetAllMetrics(ctx, metrics)
+	})
+}
+
+// ResetCounter
+// sets existing counter to zero
+func (s *Storage) ResetCounter(ctx context.Context, metricName string) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	if _, err := s.repository.GetCounterMetric(ctx, metricName); err != nil {
+		return err
+	}
+
+	var zero int64
+	metric := model.Metrics{ID: metricName, MType: model.MetricTypeCounter, Delta: &zero, Reset: true}
+	err := s.apply([]model.Metrics{metric}, func() error {
+		return s.repository.ResetCounterMetric(ctx, metricName, zero)
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.settings.InMemory && s.settings.StoreInterval == 0 && s.wal == nil && s.settings.StoragePath != "" {
+		return s.Backup(ctx)
+	}
+
+	return nil
+}
+
+// Delete
+// removes metric by type and name
+func (s *Storage) Delete(ctx context.Context, metricType string, metricName string) error {
+	if metricType != model.MetricTypeGauge && metricType != model.MetricTypeCounter {
+		return ErrInvalidMetricType
+	}
+
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	err := s.repository.DeleteMetric(ctx, metricType, metricName)
+	if err != nil {
+		return err
+	}
+
+	return s.persistDeletion(ctx)
+}
+
+// DeleteByPattern
+// removes metrics which names match shell pattern (see path.Match) and returns their count,
+// empty metric type matches metrics of both types
+func (s *Storage) DeleteByPattern(ctx context.Context, pattern string, metricType string) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return 0, fmt.Errorf("%w '%s'", ErrInvalidPattern, pattern)
+	}
+	if metricType != "" && metricType != model.MetricTypeGauge && metricType != model.MetricTypeCounter {
+		return 0, ErrInvalidMetricType
+	}
+
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	records, err := s.repository.GetAllRecords(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, record := range records {
+		if metricType != "" && record.MType != metricType {
+			continue
+		}
+		if ok, _ := path.Match(pattern, record.ID); !ok {
+			continue
+		}
+
+		err := s.repository.DeleteMetric(ctx, record.MType, record.ID)
+		if errors.Is(err, memstorage.ErrNotFound) || errors.Is(err, sql.ErrNoRows) {
+			// deleted concurrently
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	return deleted, s.persistDeletion(ctx)
+}
+
+// ExpireStale
+// removes metrics not updated for series TTL and returns their count
+func (s *Storage) ExpireStale(ctx context.Context) (int, error) {
+	if s.settings.SeriesTTL <= 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	deleted, err := s.repository.DeleteStale(ctx, time.Now().Add(-s.settings.SeriesTTL))
+	if err != nil || deleted == 0 {
+		return deleted, err
+	}
+
+	return deleted, s.persistDeletion(ctx)
+}
+
+// TrimHistory
+// removes history points expired by retention of their resolution and returns number of removed series.
+// History of postgres engine is trimmed by database, so it is a no-op there
+func (s *Storage) TrimHistory() int {
+	if s.history == nil {
+		return 0
+	}
+
+	return s.history.Trim(time.Now())
+}
+
+// persistDeletion
+// saves backup at once in memory mode, otherwise deleted metrics would come back from previous backup
+// or write-ahead log after restart
+func (s *Storage) persistDeletion(ctx context.Context) error {
+	if !s.settings.InMemory || s.settings.StoragePath == "" {
+		return nil
+	}
+
+	if err := s.Backup(ctx); err != nil {
+		return fmt.Errorf("backup after deletion: %w", err)
+	}
+
+	return nil
+}
+
+// GetHistory
+// retrieve metric history in [from, to) in resolution with given name,
+// if resolution is empty the finest one keeping the whole range with reasonable number of points is used
+func (s *Storage) GetHistory(ctx context.Context, metricType string, metricName string, from, to time.Time, resolution string) (*model.History, error) {
+	if metricType != model.MetricTypeGauge && metricType != model.MetricTypeCounter {
+		return nil, ErrInvalidMetricType
+	}
+
+	var res history.Resolution
+	if resolution == "" {
+		res = history.Choose(s.settings.Resolutions, from, to, time.Now())
+	} else {
+		var err error
+		res, err = history.Lookup(s.settings.Resolutions, resolution)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	points, err := s.repository.GetHistory(ctx, metricType, metricName, from, to, res.Step)
+	if err != nil {
+		return nil, err
+	}
+	if points == nil {
+		points = []model.HistoryPoint{}
+	}
+
+	if metricType == model.MetricTypeCounter && res.Step > 0 {
+		for i := range points {
+			if points[i].Increase != nil {
+				rate := float64(*points[i].Increase) / res.Step.Seconds()
+				points[i].Rate = &rate
+			}
+		}
+	}
+
+	return &model.History{ID: metricName, MType: metricType, Resolution: res.Name, Points: points}, nil
 }
 
 // Ping check connection with storage
-func (s *Storage) Ping() error {
-	return s.repository.Ping()
+func (s *Storage) Ping(ctx context.Context) error {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	return s.repository.Ping(ctx)
 }
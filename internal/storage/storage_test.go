@@ -2,12 +2,18 @@ package storage
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/history"
 	"github.com/derpartizanen/metrics/internal/model"
+	"github.com/derpartizanen/metrics/internal/repository/memstorage"
 )
 
 func TestStorage_Save(t *testing.T) {
@@ -27,8 +33,8 @@ func TestStorage_Save(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			store.Save(tt.mtype, tt.mname, tt.mvalue)
-			value, _ := store.Get(tt.mtype, tt.mname)
+			store.Save(context.Background(), tt.mtype, tt.mname, tt.mvalue)
+			value, _ := store.Get(context.Background(), tt.mtype, tt.mname)
 			assert.Equal(t, tt.expectedValue, value)
 		})
 	}
@@ -57,9 +63,9 @@ func TestStorage_SaveMetric(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			store.SaveMetric(tt.metric)
+			store.SaveMetric(context.Background(), tt.metric)
 			metric := model.Metrics{ID: tt.metric.ID, MType: tt.metric.MType}
-			store.GetMetric(&metric)
+			store.GetMetric(context.Background(), &metric)
 			assert.Equal(t, tt.metric, metric)
 		})
 	}
@@ -87,16 +93,16 @@ func TestStorage_SetAllMetric(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			store.SetAllMetrics(tt.metrics)
+			store.SetAllMetrics(context.Background(), tt.metrics)
 
-			res, _ := store.GetAllMetrics()
+			res, _ := store.GetAllMetrics(context.Background())
 			assert.Equal(t, tt.metrics, res)
 		})
 	}
 }
 
 func TestStorage_Backup(t *testing.T) {
-	cfg := config.ServerConfig{StoragePath: "/tmp/test_metrics_backup.json"}
+	cfg := config.ServerConfig{StoragePath: filepath.Join(t.TempDir(), "metrics.json")}
 	store := New(context.Background(), cfg)
 
 	gauge := 146.33
@@ -106,10 +112,268 @@ func TestStorage_Backup(t *testing.T) {
 	batch = append(batch, model.Metrics{ID: "Counter1", MType: "counter", Delta: &delta})
 
 	t.Run("backup", func(t *testing.T) {
-		store.SetAllMetrics(batch)
-		err := store.Backup()
+		store.SetAllMetrics(context.Background(), batch)
+		err := store.Backup(context.Background())
 		if err != nil {
 			t.Fatal(err)
 		}
 	})
+	t.Run("no storage path", func(t *testing.T) {
+		err := New(context.Background(), config.ServerConfig{}).Backup(context.Background())
+		assert.ErrorIs(t, err, ErrNoStoragePath)
+	})
+}
+
+func TestStorage_WAL(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.ServerConfig{
+		StoragePath: filepath.Join(dir, "metrics.json"),
+		WALPath:     filepath.Join(dir, "metrics.wal"),
+		WALSync:     "always",
+	}
+
+	store := New(context.Background(), cfg)
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "5"))
+	require.NoError(t, store.Backup(context.Background()))
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "2"))
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeGauge, "Alloc", "1.5"))
+	// crash without backup on shutdown
+	require.NoError(t, store.Close())
+
+	restored := New(context.Background(), cfg)
+	defer restored.Close()
+
+	value, err := restored.Get(context.Background(), model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), value)
+
+	value, err = restored.Get(context.Background(), model.MetricTypeGauge, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+}
+
+func TestStorage_WALCrashAfterBackup(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.ServerConfig{
+		StoragePath: filepath.Join(dir, "metrics.json"),
+		WALPath:     filepath.Join(dir, "metrics.wal"),
+		WALSync:     "always",
+	}
+
+	store := New(context.Background(), cfg)
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "5"))
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "2"))
+	saved, err := os.ReadFile(cfg.WALPath)
+	require.NoError(t, err)
+	require.NoError(t, store.Backup(context.Background()))
+	require.NoError(t, store.Save(context.Background(), model.MetricTypeCounter, "PollCount", "3"))
+	require.NoError(t, store.Close())
+
+	// crash after snapshot is written, but before log is truncated
+	appended, err := os.ReadFile(cfg.WALPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(cfg.WALPath, append(saved, appended...), 0o644))
+
+	restored := New(context.Background(), cfg)
+	value, err := restored.Get(context.Background(), model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), value, "records saved in snapshot should not be replayed")
+
+	require.NoError(t, restored.Save(context.Background(), model.MetricTypeCounter, "PollCount", "1"))
+	require.NoError(t, restored.Close())
+
+	restored = New(context.Background(), cfg)
+	value, err = restored.Get(context.Background(), model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), value, "records appended after restart should be replayed")
+	require.NoError(t, restored.Backup(context.Background()))
+	require.NoError(t, restored.Close())
+
+	// log is empty, sequence continues after the snapshot
+	restored = New(context.Background(), cfg)
+	require.NoError(t, restored.Save(context.Background(), model.MetricTypeCounter, "PollCount", "1"))
+	require.NoError(t, restored.Close())
+
+	restored = New(context.Background(), cfg)
+	defer restored.Close()
+
+	value, err = restored.Get(context.Background(), model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), value)
+}
+
+type slowRepository struct {
+	*memstorage.MemStorage
+}
+
+func (r slowRepository) GetRecord(ctx context.Context, _ string, _ string) (model.MetricRecord, error) {
+	<-ctx.Done()
+	return model.MetricRecord{}, ctx.Err()
+}
+
+func TestStorage_QueryTimeout(t *testing.T) {
+	store := &Storage{
+		repository: slowRepository{MemStorage: memstorage.New()},
+		settings:   Settings{QueryTimeout: 10 * time.Millisecond},
+	}
+
+	_, err := store.Get(context.Background(), model.MetricTypeGauge, "Alloc")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.GetMetric(ctx, &model.Metrics{ID: "Alloc", MType: model.MetricTypeGauge})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestStorage_Delete(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := config.ServerConfig{StoragePath: filepath.Join(dir, "metrics.json"), BackupKeep: 1}
+	store := New(ctx, cfg)
+
+	for _, name := range []string{"host1.cpu", "host1.mem", "host2.cpu"} {
+		require.NoError(t, store.Save(ctx, model.MetricTypeGauge, name, "1"))
+	}
+	require.NoError(t, store.Save(ctx, model.MetricTypeCounter, "host1.requests", "1"))
+
+	require.NoError(t, store.Delete(ctx, model.MetricTypeGauge, "host2.cpu"))
+	assert.ErrorIs(t, store.Delete(ctx, model.MetricTypeGauge, "host2.cpu"), memstorage.ErrNotFound)
+	assert.ErrorIs(t, store.Delete(ctx, "bad", "host2.cpu"), ErrInvalidMetricType)
+
+	count, err := store.DeleteByPattern(ctx, "host1.*", model.MetricTypeGauge)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	_, err = store.DeleteByPattern(ctx, "host[", "")
+	assert.ErrorIs(t, err, ErrInvalidPattern)
+
+	// deletion is saved to backup at once
+	restored := New(ctx, config.ServerConfig{StoragePath: cfg.StoragePath, Restore: true})
+	metrics, err := restored.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "host1.requests", metrics[0].ID)
+}
+
+func TestStorage_ExpireStale(t *testing.T) {
+	ctx := context.Background()
+	repo := memstorage.New()
+	store := &Storage{repository: repo, settings: Settings{SeriesTTL: time.Hour}}
+
+	value := 1.0
+	require.NoError(t, repo.RestoreRecords(ctx, []model.MetricRecord{
+		{Metrics: model.Metrics{ID: "Old", MType: model.MetricTypeGauge, Value: &value}, UpdatedAt: time.Now().Add(-2 * time.Hour)},
+	}))
+	require.NoError(t, store.Save(ctx, model.MetricTypeGauge, "Fresh", "2"))
+
+	// expired metric is hidden from listing and lookups before it is deleted
+	metrics, err := store.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "Fresh", metrics[0].ID)
+
+	_, err = store.Get(ctx, model.MetricTypeGauge, "Old")
+	assert.ErrorIs(t, err, memstorage.ErrNotFound)
+	err = store.GetMetric(ctx, &model.Metrics{ID: "Old", MType: model.MetricTypeGauge})
+	assert.ErrorIs(t, err, memstorage.ErrNotFound)
+
+	fresh, err := store.Get(ctx, model.MetricTypeGauge, "Fresh")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, fresh)
+
+	count, err := store.ExpireStale(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	_, err = store.Get(ctx, model.MetricTypeGauge, "Old")
+	assert.ErrorIs(t, err, memstorage.ErrNotFound)
+}
+
+func TestStorage_ResetCounter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cfg := config.ServerConfig{
+		StoragePath: filepath.Join(dir, "metrics.json"),
+		WALPath:     filepath.Join(dir, "metrics.wal"),
+		WALSync:     "always",
+	}
+
+	store := New(ctx, cfg)
+	require.NoError(t, store.Save(ctx, model.MetricTypeCounter, "PollCount", "5"))
+	require.NoError(t, store.ResetCounter(ctx, "PollCount"))
+	require.NoError(t, store.Save(ctx, model.MetricTypeCounter, "PollCount", "2"))
+
+	delta := int64(10)
+	require.NoError(t, store.SaveMetric(ctx, model.Metrics{ID: "Requests", MType: model.MetricTypeCounter, Delta: &delta}))
+	require.NoError(t, store.SaveMetric(ctx, model.Metrics{ID: "Requests", MType: model.MetricTypeCounter, Delta: &delta, Reset: true}))
+
+	assert.ErrorIs(t, store.ResetCounter(ctx, "Unknown"), memstorage.ErrNotFound)
+
+	// history rate never goes negative after reset
+	history, err := store.GetHistory(ctx, model.MetricTypeCounter, "PollCount", time.Now().Add(-time.Minute), time.Now().Add(time.Minute), "raw")
+	require.NoError(t, err)
+	require.Len(t, history.Points, 3)
+	assert.Equal(t, int64(5), *history.Points[0].Increase)
+	assert.Equal(t, int64(0), *history.Points[1].Increase)
+	assert.Equal(t, int64(2), *history.Points[2].Increase)
+	require.NoError(t, store.Close())
+
+	// reset is replayed from write-ahead log
+	restored := New(ctx, cfg)
+	defer restored.Close()
+
+	value, err := restored.Get(ctx, model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+
+	value, err = restored.Get(ctx, model.MetricTypeCounter, "Requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), value)
+}
+
+func TestStorage_TrimHistory(t *testing.T) {
+	store := New(context.Background(), config.ServerConfig{HistoryRetention: 30, RollupMinRetention: 1, RollupHourRetention: 1})
+
+	// raw samples are not kept in memory forever
+	raw, err := history.Lookup(store.settings.Resolutions, history.ResolutionRaw)
+	require.NoError(t, err)
+	assert.Equal(t, maxInProcessRawRetention, raw.Retention)
+
+	store.history.RecordGauge("Idle", 1, time.Now().Add(-2*maxInProcessRawRetention))
+	assert.Equal(t, 1, store.TrimHistory())
+	assert.Equal(t, 0, store.TrimHistory())
+}
+
+func TestStorage_FileEngine(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	cfg := config.ServerConfig{
+		StorageEngine: config.StorageEngineFile,
+		StorageDBPath: filepath.Join(t.TempDir(), "metrics.db"),
+		StoragePath:   filepath.Join(backupDir, "metrics.json"),
+	}
+
+	store := New(ctx, cfg)
+	delta := int64(5)
+	require.NoError(t, store.SaveMetric(ctx, model.Metrics{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta}))
+	// backup files are written in memory engine only
+	assert.Empty(t, backupFiles(cfg.StoragePath))
+	require.NoError(t, store.Save(ctx, model.MetricTypeGauge, "Alloc", "1.5"))
+	require.NoError(t, store.ResetCounter(ctx, "PollCount"))
+	require.NoError(t, store.Save(ctx, model.MetricTypeCounter, "PollCount", "2"))
+	assert.Empty(t, backupFiles(cfg.StoragePath))
+	// every update is durable without backup on shutdown
+	require.NoError(t, store.Close())
+
+	restored := New(ctx, cfg)
+	defer restored.Close()
+
+	value, err := restored.Get(ctx, model.MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+
+	value, err = restored.Get(ctx, model.MetricTypeGauge, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
 }
@@ -0,0 +1,250 @@
+// Package wal implements append-only write-ahead log of metric updates.
+// Every record is a checksummed line of JSON encoded metric framed by package framing,
+// so a record torn by crash is detected and dropped on replay.
+// Records are numbered with increasing sequence, a snapshot keeps the sequence of the last
+// record it contains, so records are not applied twice when log was not truncated after it
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/derpartizanen/metrics/internal/framing"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+// Fsync policies
+const (
+	// SyncAlways syncs file after every append, update is durable once it is acknowledged
+	SyncAlways = "always"
+	// SyncInterval syncs file in background once per SyncPeriod
+	SyncInterval = "interval"
+	// SyncNever leaves flushing to operating system
+	SyncNever = "never"
+
+	SyncPeriod = time.Second
+)
+
+var (
+	ErrInvalidSyncPolicy = errors.New("invalid wal sync policy")
+	ErrClosed            = errors.New("wal is closed")
+)
+
+type WAL struct {
+	mu     sync.Mutex
+	file   *os.File
+	policy string
+	seq    uint64
+	dirty  bool
+	closed bool
+	done   chan struct{}
+}
+
+// record is a line of log, records written before sequence was introduced have zero Seq
+type record struct {
+	Seq uint64 `json:"seq,omitempty"`
+	model.Metrics
+}
+
+// Open
+// opens or creates log file, records are appended to the end of existing log
+func Open(path string, policy string) (*WAL, error) {
+	if policy != SyncAlways && policy != SyncInterval && policy != SyncNever {
+		return nil, fmt.Errorf("%w '%s'", ErrInvalidSyncPolicy, policy)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{file: file, policy: policy, done: make(chan struct{})}
+	if policy == SyncInterval {
+		go w.syncLoop()
+	}
+
+	return w, nil
+}
+
+// Exists
+// reports whether log file exists and is not empty
+func Exists(path string) bool {
+	info, err := os.Stat(path)
+
+	return err == nil && info.Size() > 0
+}
+
+// Append
+// writes metrics to the end of log with a single write
+func (w *WAL) Append(metrics ...model.Metrics) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	var buf bytes.Buffer
+	seq := w.seq
+	for _, metric := range metrics {
+		seq++
+		line, err := framing.Encode(record{Seq: seq, Metrics: metric})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+	}
+
+	if _, err := w.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.seq = seq
+
+	if w.policy == SyncAlways {
+		return w.file.Sync()
+	}
+	w.dirty = true
+
+	return nil
+}
+
+// Replay
+// calls fn for every record in order with its sequence. Reading stops at the first damaged record,
+// the log is cut there, so new records are not appended after garbage.
+// Sequence of new records continues after the replayed ones
+func (w *WAL) Replay(fn func(seq uint64, metric model.Metrics) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(w.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				// last record was not written completely
+				return w.file.Truncate(offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rec, ok := decode(line)
+		if !ok {
+			return w.file.Truncate(offset)
+		}
+		w.seq = max(w.seq, rec.Seq)
+		if err := fn(rec.Seq, rec.Metrics); err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+}
+
+// Sequence
+// returns sequence of the last appended record
+func (w *WAL) Sequence() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.seq
+}
+
+// Advance
+// makes sequence of new records continue after seq, it is used with sequence of restored snapshot
+// when log itself is empty
+func (w *WAL) Advance(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq = max(w.seq, seq)
+}
+
+// Truncate
+// drops all records, it is called once they are saved in a snapshot. Sequence is not reset
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.dirty = false
+
+	return w.file.Sync()
+}
+
+// Sync
+// flushes appended records to disk
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.sync()
+}
+
+// Close
+// syncs and closes log file
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+
+	return w.file.Close()
+}
+
+func (w *WAL) sync() error {
+	if w.closed || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+
+	return w.file.Sync()
+}
+
+func (w *WAL) syncLoop() {
+	ticker := time.NewTicker(SyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.Sync()
+		}
+	}
+}
+
+func decode(line []byte) (record, bool) {
+	var rec record
+	ok := framing.Decode(line, &rec)
+
+	return rec, ok
+}
@@ -0,0 +1,91 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+func replayAll(t *testing.T, w *WAL) []model.Metrics {
+	t.Helper()
+
+	var metrics []model.Metrics
+	require.NoError(t, w.Replay(func(_ uint64, metric model.Metrics) error {
+		metrics = append(metrics, metric)
+		return nil
+	}))
+
+	return metrics
+}
+
+func TestWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+	assert.False(t, Exists(path))
+
+	w, err := Open(path, SyncAlways)
+	require.NoError(t, err)
+
+	delta := int64(3)
+	value := 1.5
+	require.NoError(t, w.Append(model.Metrics{ID: "PollCount", MType: model.MetricTypeCounter, Delta: &delta}))
+	require.NoError(t, w.Append(model.Metrics{ID: "Alloc", MType: model.MetricTypeGauge, Value: &value}))
+	require.NoError(t, w.Close())
+	assert.True(t, Exists(path))
+
+	w, err = Open(path, SyncNever)
+	require.NoError(t, err)
+	defer w.Close()
+
+	metrics := replayAll(t, w)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "PollCount", metrics[0].ID)
+	assert.Equal(t, int64(3), *metrics[0].Delta)
+	assert.Equal(t, 1.5, *metrics[1].Value)
+
+	assert.Equal(t, uint64(2), w.Sequence(), "sequence should continue after replayed records")
+
+	require.NoError(t, w.Truncate())
+	assert.Empty(t, replayAll(t, w))
+	assert.False(t, Exists(path))
+
+	require.NoError(t, w.Append(model.Metrics{ID: "Alloc", MType: model.MetricTypeGauge, Value: &value}))
+	assert.Equal(t, uint64(3), w.Sequence(), "truncate should not reset sequence")
+}
+
+func TestWAL_TornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+
+	w, err := Open(path, SyncInterval)
+	require.NoError(t, err)
+	value := 1.5
+	require.NoError(t, w.Append(model.Metrics{ID: "Alloc", MType: model.MetricTypeGauge, Value: &value}))
+	require.NoError(t, w.Close())
+
+	// simulate crash in the middle of write
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`0badc0de {"id":"Sys","ty`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = Open(path, SyncNever)
+	require.NoError(t, err)
+	defer w.Close()
+
+	metrics := replayAll(t, w)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "Alloc", metrics[0].ID)
+
+	require.NoError(t, w.Append(model.Metrics{ID: "Sys", MType: model.MetricTypeGauge, Value: &value}))
+	assert.Len(t, replayAll(t, w), 2, "records appended after replay should follow the last valid one")
+}
+
+func TestOpen_InvalidPolicy(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "metrics.wal"), "sometimes")
+	assert.ErrorIs(t, err, ErrInvalidSyncPolicy)
+}
@@ -0,0 +1,460 @@
+// Package client is a Go client of metrics server.
+// It compresses requests with gzip, signs them with HMAC-SHA256 hash key,
+// encrypts them with server's public key and retries failed requests.
+// Updates are not idempotent, so they are retried only if they were not sent to server
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/derpartizanen/metrics/internal/compressor"
+	"github.com/derpartizanen/metrics/internal/crypto"
+	"github.com/derpartizanen/metrics/internal/hash"
+	"github.com/derpartizanen/metrics/internal/model"
+)
+
+const (
+	HashHeader = "HashSHA256"
+
+	MetricTypeCounter = model.MetricTypeCounter
+	MetricTypeGauge   = model.MetricTypeGauge
+
+	defaultRetryAttempts = 3
+)
+
+type (
+	Metrics       = model.Metrics
+	Limits        = model.Limits
+	AgentSettings = model.AgentSettings
+)
+
+var (
+	// ErrRequest is returned when request can't be executed or server fails with 5xx status, such requests are retried,
+	// updates only along with ErrNotSent
+	ErrRequest = errors.New("execution request error")
+	// ErrNotSent is returned along with ErrRequest when request failed before it was written to connection,
+	// so server has not applied it and it is safe to repeat
+	ErrNotSent      = errors.New("request was not sent")
+	ErrStatus       = errors.New("unexpected response status")
+	ErrTooLarge     = errors.New("batch is too large for server")
+	ErrNotFound     = errors.New("not found")
+	ErrHashMismatch = errors.New("response hash mismatch")
+)
+
+// Client of metrics server
+type Client struct {
+	baseURL       string
+	httpClient    *http.Client
+	hashKey       string
+	pubKey        []byte
+	retryAttempts int
+	onRetry       func(attempt int, err error)
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets http client used for requests
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithHashKey sets key of HMAC-SHA256 signature of request bodies
+func WithHashKey(key string) Option {
+	return func(c *Client) {
+		c.hashKey = key
+	}
+}
+
+// WithPublicKey sets DER encoded public key used to encrypt request bodies, see ReadPublicKey
+func WithPublicKey(pubKey []byte) Option {
+	return func(c *Client) {
+		c.pubKey = pubKey
+	}
+}
+
+// WithRetries sets number of attempts of failed requests, 1 disables retries
+func WithRetries(attempts int) Option {
+	return func(c *Client) {
+		c.retryAttempts = attempts
+	}
+}
+
+// WithRetryHook sets function called before every retry
+func WithRetryHook(hook func(attempt int, err error)) Option {
+	return func(c *Client) {
+		c.onRetry = hook
+	}
+}
+
+// ReadPublicKey
+// reads PEM encoded public key from file
+func ReadPublicKey(path string) ([]byte, error) {
+	return crypto.ReadKeyFile(path)
+}
+
+// New
+// creates client of server listening on address, e.g. localhost:8080
+func New(address string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:       "http://" + address,
+		httpClient:    http.DefaultClient,
+		retryAttempts: defaultRetryAttempts,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Batch is an encoded batch update request
+type Batch struct {
+	Count int
+	// CompressedSize is a size of gzipped body before encryption
+	CompressedSize int
+	body           []byte
+	hash           string
+}
+
+// Size
+// returns size of request body
+func (b *Batch) Size() int {
+	return len(b.body)
+}
+
+// EncodeBatch
+// prepares batch update request, so its size can be checked before sending
+func (c *Client) EncodeBatch(metrics []Metrics) (*Batch, error) {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal data: %w", err)
+	}
+
+	body, compressedSize, err := c.encodeBody(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Batch{Count: len(metrics), CompressedSize: compressedSize, body: body, hash: c.sign(data)}, nil
+}
+
+// SendBatch
+// sends encoded batch to /updates/
+func (c *Client) SendBatch(ctx context.Context, b *Batch) error {
+	return c.withRetry(ctx, false, func() error {
+		res, err := c.do(ctx, http.MethodPost, "/updates/", b.body, b.hash, true)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		return nil
+	})
+}
+
+// UpdateBatch
+// updates multiple metrics with single request
+func (c *Client) UpdateBatch(ctx context.Context, metrics []Metrics) error {
+	b, err := c.EncodeBatch(metrics)
+	if err != nil {
+		return err
+	}
+
+	return c.SendBatch(ctx, b)
+}
+
+// Update
+// updates metric and returns its new value
+func (c *Client) Update(ctx context.Context, metric Metrics) (Metrics, error) {
+	var result Metrics
+	err := c.postJSON(ctx, "/update/", metric, &result, false)
+
+	return result, err
+}
+
+// UpdateValue
+// updates metric by type, name and value in URL
+func (c *Client) UpdateValue(ctx context.Context, metricType string, metricName string, value string) error {
+	path := fmt.Sprintf("/update/%s/%s/%s", url.PathEscape(metricType), url.PathEscape(metricName), url.PathEscape(value))
+
+	return c.withRetry(ctx, false, func() error {
+		res, err := c.do(ctx, http.MethodPost, path, nil, "", false)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		return nil
+	})
+}
+
+// Get
+// returns metric by type and ID
+func (c *Client) Get(ctx context.Context, metricType string, id string) (Metrics, error) {
+	var result Metrics
+	err := c.postJSON(ctx, "/value/", Metrics{ID: id, MType: metricType}, &result, true)
+
+	return result, err
+}
+
+// GetValue
+// returns metric value as formatted by server
+func (c *Client) GetValue(ctx context.Context, metricType string, metricName string) (string, error) {
+	path := fmt.Sprintf("/value/%s/%s", url.PathEscape(metricType), url.PathEscape(metricName))
+
+	var data []byte
+	err := c.withRetry(ctx, true, func() (err error) {
+		data, err = c.get(ctx, path)
+		return err
+	})
+
+	return string(data), err
+}
+
+// List
+// returns values of all metrics by their names as formatted by server
+func (c *Client) List(ctx context.Context) (map[string]string, error) {
+	var data []byte
+	err := c.withRetry(ctx, true, func() (err error) {
+		data, err = c.get(ctx, "/")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(line, ": ")
+		if ok {
+			result[name] = value
+		}
+	}
+
+	return result, nil
+}
+
+// Ping
+// checks server and its storage are available, it is not retried
+func (c *Client) Ping(ctx context.Context) error {
+	res, err := c.do(ctx, http.MethodGet, "/ping", nil, "", false)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
+
+// Limits
+// returns batch limits accepted by server, it is not retried
+func (c *Client) Limits(ctx context.Context) (Limits, error) {
+	var limits Limits
+	data, err := c.get(ctx, "/limits")
+	if err != nil {
+		return limits, err
+	}
+
+	err = json.Unmarshal(data, &limits)
+
+	return limits, err
+}
+
+// AgentSettings
+// returns remote settings of agent by its identity and group, it is not retried
+func (c *Client) AgentSettings(ctx context.Context, id string, group string) (AgentSettings, error) {
+	var settings AgentSettings
+
+	query := url.Values{}
+	query.Set("id", id)
+	query.Set("group", group)
+	data, err := c.get(ctx, "/agent/settings?"+query.Encode())
+	if err != nil {
+		return settings, err
+	}
+
+	err = json.Unmarshal(data, &settings)
+
+	return settings, err
+}
+
+func (c *Client) postJSON(ctx context.Context, path string, payload interface{}, result interface{}, idempotent bool) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("can't marshal data: %w", err)
+	}
+
+	body, _, err := c.encodeBody(data)
+	if err != nil {
+		return err
+	}
+
+	return c.withRetry(ctx, idempotent, func() error {
+		res, err := c.do(ctx, http.MethodPost, path, body, c.sign(data), true)
+		if err != nil {
+			return err
+		}
+
+		respData, err := c.readBody(res)
+		if err != nil {
+			return err
+		}
+
+		return json.Unmarshal(respData, result)
+	})
+}
+
+func (c *Client) get(ctx context.Context, path string) ([]byte, error) {
+	res, err := c.do(ctx, http.MethodGet, path, nil, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.readBody(res)
+}
+
+// encodeBody
+// compresses data and encrypts it if public key is set, returns body and compressed size
+func (c *Client) encodeBody(data []byte) ([]byte, int, error) {
+	body, err := compressor.Compress(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't compress data: %w", err)
+	}
+	compressedSize := len(body)
+
+	if len(c.pubKey) > 0 {
+		body, err = crypto.Encrypt(body, c.pubKey)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to encode request body: %w", err)
+		}
+	}
+
+	return body, compressedSize, nil
+}
+
+func (c *Client) sign(data []byte) string {
+	if c.hashKey == "" {
+		return ""
+	}
+
+	return hash.Calc(c.hashKey, data)
+}
+
+// do
+// executes request and converts error statuses to errors, caller must close body of returned response
+func (c *Client) do(ctx context.Context, method string, path string, body []byte, bodyHash string, gzipped bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("new request error: %w", err)
+	}
+
+	var sent atomic.Bool
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			sent.Store(info.Err == nil)
+		},
+	}))
+
+	req.Header.Set("Accept-Encoding", "gzip")
+	if gzipped {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if bodyHash != "" {
+		req.Header.Set(HashHeader, bodyHash)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		if !sent.Load() {
+			return nil, fmt.Errorf("%w: %w: %w", ErrRequest, ErrNotSent, err)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrRequest, err)
+	}
+
+	if res.StatusCode == http.StatusOK {
+		return res, nil
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %w %d", ErrNotFound, ErrStatus, res.StatusCode)
+	case res.StatusCode == http.StatusRequestEntityTooLarge:
+		return nil, ErrTooLarge
+	case res.StatusCode >= http.StatusInternalServerError:
+		return nil, fmt.Errorf("%w: %w %d", ErrRequest, ErrStatus, res.StatusCode)
+	}
+
+	return nil, fmt.Errorf("%w %d", ErrStatus, res.StatusCode)
+}
+
+// readBody
+// reads and closes response body, decompresses it and verifies its hash if hash key is set
+func (c *Client) readBody(res *http.Response) ([]byte, error) {
+	defer res.Body.Close()
+
+	var reader io.Reader = res.Body
+	if strings.Contains(res.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.hashKey != "" && res.Header.Get(HashHeader) != "" && res.Header.Get(HashHeader) != hash.Calc(c.hashKey, data) {
+		return nil, ErrHashMismatch
+	}
+
+	return data, nil
+}
+
+// withRetry
+// repeats fn while it fails with ErrRequest, delays between attempts are 1s, 3s, 5s and so on.
+// Request which is not idempotent is repeated only if it was not sent, since server may have applied it
+// before it failed
+func (c *Client) withRetry(ctx context.Context, idempotent bool, fn func() error) error {
+	var err error
+	for i := 1; i <= c.retryAttempts || i == 1; i++ {
+		err = fn()
+		if err == nil || !errors.Is(err, ErrRequest) || i >= c.retryAttempts {
+			return err
+		}
+		if !idempotent && !errors.Is(err, ErrNotSent) {
+			return err
+		}
+
+		if c.onRetry != nil {
+			c.onRetry(i, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(i+i-1) * time.Second):
+		}
+	}
+
+	return err
+}
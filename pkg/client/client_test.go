@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/derpartizanen/metrics/internal/config"
+	"github.com/derpartizanen/metrics/internal/handler"
+	"github.com/derpartizanen/metrics/internal/handler/middlewares"
+	"github.com/derpartizanen/metrics/internal/storage"
+)
+
+const testKey = "secret"
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	cfg := config.ServerConfig{Key: testKey}
+	h := handler.NewHandler(storage.New(context.Background(), cfg), cfg.Key)
+
+	r := chi.NewRouter()
+	r.Use(middlewares.GzipMiddleware)
+	r.Use(middlewares.NewHashMiddleware(cfg.Key).VerifyHash)
+	r.Get("/", h.GetAllHandler)
+	r.Get("/value/{metricType}/{metricName}", h.GetHandler)
+	r.Post("/update/{metricType}/{metricName}/{metricValue}", h.UpdateHandler)
+	r.Post("/value/", h.GetJSONHandler)
+	r.Post("/update/", h.UpdateJSONHandler)
+	r.Post("/updates/", h.BatchUpdateJSONHandler)
+	r.Get("/ping", h.PingHandler)
+	r.Get("/limits", h.LimitsHandler)
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	srv := newTestServer(t)
+	c := New(srv.Listener.Addr().String(), WithHashKey(testKey), WithRetries(1))
+	ctx := context.Background()
+
+	delta := int64(5)
+	value := 1.5
+	require.NoError(t, c.UpdateBatch(ctx, []Metrics{
+		{ID: "PollCount", MType: MetricTypeCounter, Delta: &delta},
+		{ID: "Alloc", MType: MetricTypeGauge, Value: &value},
+	}))
+
+	updated, err := c.Update(ctx, Metrics{ID: "PollCount", MType: MetricTypeCounter, Delta: &delta})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), *updated.Delta)
+
+	require.NoError(t, c.UpdateValue(ctx, MetricTypeGauge, "Sys", "2.5"))
+
+	metric, err := c.Get(ctx, MetricTypeGauge, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *metric.Value)
+
+	got, err := c.GetValue(ctx, MetricTypeCounter, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, "10", got)
+
+	all, err := c.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+	assert.Equal(t, "10", all["PollCount"])
+
+	_, err = c.GetValue(ctx, MetricTypeGauge, "Unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = c.Limits(ctx)
+	assert.NoError(t, err)
+}
+
+func TestClient_WrongHashKey(t *testing.T) {
+	srv := newTestServer(t)
+	c := New(srv.Listener.Addr().String(), WithHashKey("wrong"), WithRetries(1))
+
+	err := c.UpdateValue(context.Background(), MetricTypeGauge, "Alloc", "1")
+	require.NoError(t, err, "requests without body are not signed")
+
+	value := 1.0
+	err = c.UpdateBatch(context.Background(), []Metrics{{ID: "Alloc", MType: MetricTypeGauge, Value: &value}})
+	assert.ErrorIs(t, err, ErrStatus)
+
+	_, err = c.List(context.Background())
+	assert.ErrorIs(t, err, ErrHashMismatch)
+}
+
+func TestClient_Retry(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	var retries []int
+	c := New(srv.Listener.Addr().String(), WithRetries(2), WithRetryHook(func(attempt int, err error) {
+		assert.ErrorIs(t, err, ErrRequest)
+		retries = append(retries, attempt)
+	}))
+
+	_, err := c.List(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, []int{1}, retries)
+}
+
+func TestClient_RetryUpdate(t *testing.T) {
+	value := 1.0
+	metrics := []Metrics{{ID: "Alloc", MType: MetricTypeGauge, Value: &value}}
+
+	t.Run("server error", func(t *testing.T) {
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer srv.Close()
+
+		// server may have applied batch before it failed, so batch is not repeated
+		c := New(srv.Listener.Addr().String(), WithRetries(2))
+		err := c.UpdateBatch(context.Background(), metrics)
+		assert.ErrorIs(t, err, ErrRequest)
+		assert.NotErrorIs(t, err, ErrNotSent)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("not sent", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		address := srv.Listener.Addr().String()
+		srv.Close()
+
+		var retries []int
+		c := New(address, WithRetries(2), WithRetryHook(func(attempt int, err error) {
+			assert.ErrorIs(t, err, ErrNotSent)
+			retries = append(retries, attempt)
+		}))
+		err := c.UpdateBatch(context.Background(), metrics)
+		assert.ErrorIs(t, err, ErrNotSent)
+		assert.Equal(t, []int{1}, retries)
+	})
+}
+
+func TestClient_TooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer srv.Close()
+
+	c := New(srv.Listener.Addr().String())
+	b, err := c.EncodeBatch([]Metrics{{ID: "Alloc", MType: MetricTypeGauge}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, b.Count)
+	assert.Equal(t, b.CompressedSize, b.Size())
+
+	assert.ErrorIs(t, c.SendBatch(context.Background(), b), ErrTooLarge)
+}